@@ -0,0 +1,112 @@
+package inverted
+
+import (
+	"runtime"
+	"sync"
+)
+
+// BatchDocument is a document and its categories added by AddBatch
+type BatchDocument struct {
+	Document   *Document
+	Categories []string
+}
+
+// BatchResult is the outcome of adding a document of a batch, DocId is
+// valid only if Err is nil
+type BatchResult struct {
+	DocId uint32
+	Err   error
+}
+
+// BatchOptions controls how AddBatch indexes documents
+type BatchOptions struct {
+	// Workers is the number of goroutines analyzing documents,
+	// runtime.GOMAXPROCS(0) is used if it is not positive
+	Workers int
+
+	// Progress is called after every document of the batch is added or
+	// has failed with the number of documents done and the batch size.
+	// It is called from the goroutine calling AddBatch
+	Progress func(done, total int)
+}
+
+// batchItem is a document of a batch analyzed by a worker
+type batchItem struct {
+	pos int
+	doc *analyzedDocument
+}
+
+/*
+AddBatch adds docs to the index and returns the result of each document in
+the same order. Documents are analyzed in parallel by opts.Workers goroutines
+and added to the index in the order of docs, so docIds increase along the
+batch just like calling AddDocument for each document.
+
+A document that cannot be added does not stop the batch, its error is
+reported in its result. Searches run between documents of the batch and
+see the documents added so far.
+*/
+func (idx *InvertedIndex) AddBatch(docs []BatchDocument, opts BatchOptions) []BatchResult {
+	results := make([]BatchResult, len(docs))
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	jobs := make(chan int)
+	analyzed := make(chan batchItem, workers)
+
+	go func() {
+		for i := range docs {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				analyzed <- batchItem{i, idx.prepareDocument(docs[i].Document, docs[i].Categories)}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(analyzed)
+	}()
+
+	// documents are analyzed out of order, keep them until
+	// all documents before them are added
+	pending := make(map[int]*analyzedDocument)
+	next := 0
+
+	for item := range analyzed {
+		pending[item.pos] = item.doc
+
+		for {
+			ad, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+
+			idx.mu.Lock()
+			docId, err := idx.addDocument(ad)
+			idx.mu.Unlock()
+
+			results[next] = BatchResult{DocId: docId, Err: err}
+			next++
+
+			if opts.Progress != nil {
+				opts.Progress(next, len(docs))
+			}
+		}
+	}
+
+	return results
+}
@@ -2,10 +2,59 @@ package inverted
 
 import "math"
 
+// BM25 is the Okapi BM25 similarity, K1 controls how quickly the score
+// saturates with term frequency and B how much field length normalizes it.
+// Common values are K1 = 1.2 and B = 0.75
+type BM25 struct {
+	K1 float64
+	B  float64
+}
+
 func idf(docFreq, docCount float64) float64 {
 	return math.Log(1 + (docCount-docFreq+0.5)/(docFreq+0.5))
 }
 
-func tf(termFreq, fieldLen, avgFieldLen float64) float64 {
-	return (termFreq * 2.2) / (termFreq + 1.2*(0.25+0.75*(fieldLen/avgFieldLen)))
+// bm25Scorer computes weight * freq / (freq + cache[norm]) + delta
+type bm25Scorer struct {
+	weight float64
+	delta  float64
+	cache  *[256]float64
+}
+
+func (s BM25) Scorer(stats *TermStats) TermScorer {
+	return newBM25Scorer(s.K1, s.B, 0, stats)
+}
+
+func newBM25Scorer(k1, b, delta float64, stats *TermStats) *bm25Scorer {
+	idf := idf(stats.DocFreq, stats.DocCount)
+
+	return &bm25Scorer{
+		weight: idf * (k1 + 1),
+		delta:  idf * delta,
+		cache: normCache(func(fieldLen float64) float64 {
+			return k1 * (1 - b + b*fieldLen/stats.AvgFieldLen)
+		}),
+	}
+}
+
+func (s *bm25Scorer) Score(freq float64, norm byte) float64 {
+	return s.weight*freq/(freq+s.cache[norm]) + s.delta
+}
+
+// MaxScore uses the limit of the score for large term frequencies
+func (s *bm25Scorer) MaxScore() float64 {
+	return s.weight + s.delta
+}
+
+// BM25Plus is BM25 with a lower bound Delta added to the score of every
+// matching document, so long fields are not scored close to missing
+// the term. Delta is usually 1
+type BM25Plus struct {
+	K1    float64
+	B     float64
+	Delta float64
+}
+
+func (s BM25Plus) Scorer(stats *TermStats) TermScorer {
+	return newBM25Scorer(s.K1, s.B, s.Delta, stats)
 }
@@ -0,0 +1,202 @@
+package inverted
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tests in this file are meant to be run with the race detector,
+// go test -race -run Concurrent
+
+var concurrentWords = []string{"kitap", "kalem", "defter", "silgi", "masa"}
+
+func newConcurrentIndex(t *testing.T) *InvertedIndex {
+	schema := NewSchema(DefaultField, newTestAnalyzer())
+	assert.NoError(t, schema.AddField(DefaultField, FieldOptions{Analyzer: newTestAnalyzer(), Stored: true}))
+	assert.NoError(t, schema.AddField("id", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer())}))
+	assert.NoError(t, schema.SetIDField("id"))
+
+	idx, err := Create(t.TempDir(), Options{Schema: schema})
+	assert.NoError(t, err)
+	return idx
+}
+
+func concurrentDocument(i int) (string, []string) {
+	body := fmt.Sprintf("ortak %s %s", concurrentWords[i%len(concurrentWords)], concurrentWords[(i+1)%len(concurrentWords)])
+	return body, []string{concurrentWords[i%len(concurrentWords)]}
+}
+
+func TestConcurrentAddAndSearch(t *testing.T) {
+	idx := newConcurrentIndex(t)
+
+	const writers = 4
+	const docsPerWriter = 50
+	const readers = 8
+
+	done := make(chan struct{})
+	var writing, reading sync.WaitGroup
+
+	for w := 0; w < writers; w++ {
+		writing.Add(1)
+		go func(w int) {
+			defer writing.Done()
+			for i := 0; i < docsPerWriter; i++ {
+				body, categories := concurrentDocument(w*docsPerWriter + i)
+				_, err := idx.Add(body, categories)
+				assert.NoError(t, err)
+
+				if i%10 == 0 {
+					idx.UpdateAvgFieldLen()
+					idx.BuildCategoryBitmap()
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		reading.Add(1)
+		go func(r int) {
+			defer reading.Done()
+			word := concurrentWords[r%len(concurrentWords)]
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// every hit is a document containing all terms of the query
+				postings := search(t, idx, "ortak "+word)
+				for _, hit := range idx.Hits(postings) {
+					doc, err := idx.Document(hit.DocId)
+					if assert.NoError(t, err) {
+						assert.True(t, strings.Contains(doc.Get(DefaultField), word))
+					}
+				}
+
+				idx.GetFacetCounts(postings)
+				idx.Suggest(word[:2], 3)
+				idx.SpellCheck(word + "x")
+
+				_, err := idx.ExecuteTop(&BooleanQuery{Should: []Query{
+					&TermQuery{Field: DefaultField, Term: word},
+					&TermQuery{Field: DefaultField, Term: "ortak"},
+				}}, SearchOptions{Size: 5})
+				assert.NoError(t, err)
+			}
+		}(r)
+	}
+
+	writing.Wait()
+	close(done)
+	reading.Wait()
+
+	idx.UpdateAvgFieldLen()
+	idx.BuildCategoryBitmap()
+
+	all := search(t, idx, "ortak")
+	assert.Len(t, all, writers*docsPerWriter)
+
+	counts := idx.GetFacetCounts(all)
+	assert.Len(t, counts, len(concurrentWords))
+	for _, fc := range counts {
+		assert.Equal(t, writers*docsPerWriter/len(concurrentWords), fc.Count, fc.Name)
+	}
+}
+
+func TestConcurrentUpdateAndMarshal(t *testing.T) {
+	idx := newConcurrentIndex(t)
+	idx.mergePolicy = &LogByteSizeMergePolicy{MergeFactor: 2}
+
+	const ids = 20
+	var wg sync.WaitGroup
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ids; i++ {
+				body, _ := concurrentDocument(w + i)
+				doc := NewDocument().AddField(DefaultField, body)
+				_, err := idx.Update(fmt.Sprint(i), doc, nil)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < ids; i++ {
+				search(t, idx, "ortak")
+				if docId, err := idx.DocIdFor(fmt.Sprint(i)); err == nil {
+					idx.ExternalId(docId)
+					idx.IsDeleted(docId)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, idx.MarshalIndex())
+		}
+		assert.NoError(t, idx.ForceMerge())
+	}()
+
+	wg.Wait()
+
+	assert.NoError(t, idx.MarshalIndex())
+	assert.Len(t, search(t, idx, "ortak"), ids)
+	assert.NoError(t, idx.Close())
+
+	onDisk, err := Open(idx.Dir(), Options{Schema: idx.schema})
+	assert.NoError(t, err)
+	assert.Len(t, search(t, onDisk, "ortak"), ids)
+	assert.NoError(t, onDisk.Close())
+}
+
+func TestConcurrentSearchOnDisk(t *testing.T) {
+	idx := newConcurrentIndex(t)
+	for i := 0; i < 300; i++ {
+		body, categories := concurrentDocument(i)
+		_, err := idx.Add(body, categories)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.MarshalIndex())
+
+	for _, memoryMap := range []bool{false, true} {
+		readOnly, err := Open(idx.Dir(), Options{Schema: idx.Schema(), MemoryMap: memoryMap})
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for r := 0; r < 8; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				word := concurrentWords[r%len(concurrentWords)]
+				for i := 0; i < 20; i++ {
+					postings, err := readOnly.Search_Mixed("ortak " + word)
+					assert.NoError(t, err)
+					assert.Len(t, postings, 120)
+
+					doc, err := readOnly.Document(postings[0].DocId)
+					if assert.NoError(t, err) {
+						assert.Contains(t, doc.Get(DefaultField), word)
+					}
+					readOnly.GetFacetCounts(postings)
+				}
+			}(r)
+		}
+		wg.Wait()
+
+		assert.NoError(t, readOnly.Close())
+	}
+}
@@ -0,0 +1,141 @@
+package inverted
+
+import "sort"
+
+// conjunctionTerm is a term of a conjunction and its posting list
+type conjunctionTerm struct {
+	it     *postingIterator
+	scorer TermScorer
+	norms  []byte
+	boost  float32
+}
+
+// leadingTerms returns the TermQuery clauses at the start of clauses
+func leadingTerms(clauses []Query) []*TermQuery {
+	terms := make([]*TermQuery, 0)
+	for _, clause := range clauses {
+		tq, ok := clause.(*TermQuery)
+		if !ok {
+			break
+		}
+		terms = append(terms, tq)
+	}
+	return terms
+}
+
+/*
+executeConjunction returns documents containing every term scored like the
+intersection of results of TermQuery clauses, scores are summed in clause
+order. Posting lists are read from disk and iterated together starting
+with the rarest term, every list is advanced to the document the others are
+on so blocks of long lists that cannot match are skipped without being
+decoded. Segments hold distinct documents and are intersected one by one.
+
+It returns false if posting lists are not on disk or written before posting
+formats had blocks, the clauses have to be executed one by one then.
+*/
+func (idx *InvertedIndex) executeConjunction(terms []*TermQuery) ([]scoreDoc, bool, error) {
+	segments, ok, err := idx.iterableSegments()
+	if !ok || err != nil {
+		return nil, false, err
+	}
+
+	clauses := make([]conjunctionTerm, len(terms))
+	for i, term := range terms {
+		key := fieldTerm(term.Field, term.Term)
+
+		clauses[i] = conjunctionTerm{
+			scorer: idx.fieldSimilarity(term.Field).Scorer(idx.keyStats(key, nil)),
+			norms:  idx.norms[term.Field],
+			boost:  boostOrOne(term.Boost),
+		}
+	}
+
+	result := make([]scoreDoc, 0)
+
+	for _, s := range segments {
+		scores, err := idx.conjoinSegment(s, terms, clauses)
+		if err != nil {
+			return nil, false, err
+		}
+		result = unionScores(result, scores)
+	}
+
+	return result, true, nil
+}
+
+// conjoinSegment intersects posting lists of terms in a segment, clauses
+// are the scorers of terms and get iterators of the segment
+func (idx *InvertedIndex) conjoinSegment(s *segmentFiles, terms []*TermQuery, clauses []conjunctionTerm) ([]scoreDoc, error) {
+	for i, term := range terms {
+		buf, err := s.postingList(fieldTerm(term.Field, term.Term))
+		if err != nil {
+			return nil, err
+		}
+
+		if buf == nil {
+			return nil, nil
+		}
+
+		clauses[i].it, err = newPostingIterator(buf, s.format)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// lists are advanced from the shortest one
+	order := make([]*postingIterator, len(clauses))
+	for i := range clauses {
+		order[i] = clauses[i].it
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].count < order[j].count })
+
+	result := make([]scoreDoc, 0)
+	lead := order[0]
+
+	for more := lead.Next(); more; {
+		docId := lead.DocId()
+
+		matched := true
+		for _, it := range order[1:] {
+			if !it.Advance(docId) {
+				more = false
+				matched = false
+				break
+			}
+
+			if it.DocId() > docId {
+				more = lead.Advance(it.DocId())
+				matched = false
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		if !idx.deleted.Contains(docId) {
+			var score float32
+			for _, c := range clauses {
+				var norm byte
+				if docId < uint32(len(c.norms)) {
+					norm = c.norms[docId]
+				}
+				// rounded before the sum like boostScores results
+				score += float32(float32(c.scorer.Score(float64(c.it.Freq()), norm)) * c.boost)
+			}
+			result = append(result, scoreDoc{docId, score})
+		}
+
+		more = lead.Next()
+	}
+
+	for _, c := range clauses {
+		if err := c.it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package inverted
+
+import (
+	"sort"
+	"strings"
+)
+
+// termDictionary returns all term dictionary keys sorted by value, it is
+// built on first use by whichever search needs it
+func (idx *InvertedIndex) termDictionary() []Term {
+	idx.termsMu.Lock()
+	defer idx.termsMu.Unlock()
+
+	if idx.terms == nil && idx.metadata != nil {
+		// terms that cannot be decoded are not found
+		terms, _ := idx.metadata.allTerms()
+		return terms
+	}
+
+	if idx.terms == nil {
+		terms := make([]Term, 0, len(idx.index))
+		for k, v := range idx.index {
+			// deleted documents stay in postings until MarshalIndex
+			docFreq := uint32(0)
+			for _, posting := range v {
+				if !idx.deleted.Contains(posting.DocId) {
+					docFreq++
+				}
+			}
+
+			if docFreq > 0 {
+				terms = append(terms, Term{Value: k, DocFreq: docFreq})
+			}
+		}
+		sort.Sort(ByValue(terms))
+		idx.terms = terms
+	}
+
+	return idx.terms
+}
+
+// expandPrefix returns terms of the dictionary whose key starts with prefix
+func (idx *InvertedIndex) expandPrefix(prefix string) []Term {
+	if idx.metadata != nil {
+		return idx.metadata.expandPrefix(prefix)
+	}
+
+	terms := idx.termDictionary()
+
+	first := FindFirst(terms, prefix)
+	if first >= len(terms) || !strings.HasPrefix(terms[first].Value, prefix) {
+		return nil
+	}
+
+	last := FindLast(terms, prefix)
+
+	return terms[first : last+1]
+}
+
+// lookupTerm finds the term with dictionary key
+func (idx *InvertedIndex) lookupTerm(key string) (Term, bool) {
+	if idx.metadata != nil {
+		return idx.metadata.lookupTerm(key)
+	}
+
+	terms := idx.termDictionary()
+
+	i := sort.Search(len(terms), func(i int) bool { return terms[i].Value >= key })
+	if i < len(terms) && terms[i].Value == key {
+		return terms[i], true
+	}
+	return Term{}, false
+}
+
+// docFreq returns the number of documents containing the term dictionary key
+func (idx *InvertedIndex) docFreq(key string) int {
+	term, _ := idx.lookupTerm(key)
+	return int(term.DocFreq)
+}
+
+// normalizeTerm analyzes a partial term like a prefix with the analyzer of
+// field, text is used as is if it is not analyzed into a single token
+func (idx *InvertedIndex) normalizeTerm(field, text string) string {
+	return normalizeTerm(idx.schema.Analyzer(field), text)
+}
+
+func normalizeTerm(analyzer Analyzer, text string) string {
+	tokens := analyzer.Analyze(text)
+	if len(tokens) == 1 && tokens[0].value != "" {
+		return tokens[0].value
+	}
+	return text
+}
+
+// Suggest returns up to n terms of the default field starting with prefix,
+// the most frequent terms first, every such term if n <= 0. Count of each
+// suggestion is the number of documents containing the term
+func (idx *InvertedIndex) Suggest(prefix string, n int) []FacetCount {
+	return idx.SuggestField(idx.schema.DefaultField(), prefix, n)
+}
+
+// SuggestField returns up to n terms of field starting with prefix
+func (idx *InvertedIndex) SuggestField(field, prefix string, n int) []FacetCount {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	prefix = idx.normalizeTerm(field, prefix)
+
+	suggestions := make([]FacetCount, 0)
+	for _, term := range idx.expandPrefix(fieldTerm(field, prefix)) {
+		_, value := splitFieldTerm(term.Value)
+		suggestions = append(suggestions, FacetCount{value, int(term.DocFreq)})
+	}
+
+	// terms are sorted alphabetically, keep that order for equal counts
+	sort.Stable(byFacetCount(suggestions))
+
+	if n > 0 && len(suggestions) > n {
+		suggestions = suggestions[:n]
+	}
+
+	return suggestions
+}
@@ -0,0 +1,256 @@
+package inverted
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/colinmarc/cdb"
+)
+
+// diskIndex holds files of the segments of an index persisted by
+// MarshalIndex open while the index is searched from disk. Readers of the
+// files only use ReadAt or read mapped memory so they are shared by
+// concurrent searches
+type diskIndex struct {
+	segments []*segmentFiles
+}
+
+// segmentFiles holds files of a segment open for reading
+type segmentFiles struct {
+	*segment
+
+	postings  cdbReader
+	documents cdbReader
+
+	// posting format of the postings file
+	format byte
+}
+
+// openDiskIndex opens files of segments of the index in dir, with
+// memoryMap files are mapped into memory and postings are decoded from
+// the mapped bytes
+func openDiskIndex(dir string, segments []*segment, memoryMap bool) (*diskIndex, error) {
+	d := &diskIndex{segments: make([]*segmentFiles, 0, len(segments))}
+
+	for _, s := range segments {
+		files, err := openSegmentFiles(dir, s, memoryMap)
+		if err != nil {
+			d.close()
+			return nil, err
+		}
+		d.segments = append(d.segments, files)
+	}
+
+	return d, nil
+}
+
+func openSegmentFiles(dir string, s *segment, memoryMap bool) (*segmentFiles, error) {
+	open := func(name string) (cdbReader, error) {
+		if memoryMap {
+			return openMappedCDB(filepath.Join(dir, name))
+		}
+		return cdb.Open(filepath.Join(dir, name))
+	}
+
+	postings, err := open(s.postingsFile())
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := readPostingFormat(postings)
+	if err != nil {
+		postings.Close()
+		return nil, err
+	}
+
+	// indexes written before stored fields were persisted by the library
+	// may have no document store
+	documents, err := open(s.documentsFile())
+	if err != nil && !(s.gen == 0 && os.IsNotExist(err)) {
+		postings.Close()
+		return nil, err
+	}
+
+	return &segmentFiles{segment: s, postings: postings, documents: documents, format: format}, nil
+}
+
+// postingList returns the encoded posting list of a term dictionary key in
+// the segment, nil if the term does not exist
+func (s *segmentFiles) postingList(key string) ([]byte, error) {
+	key, ok := s.postingKey(key)
+	if !ok {
+		return nil, nil
+	}
+	return s.postings.Get([]byte(key))
+}
+
+// legacyDocument reads stored fields of a document of a segment without a
+// document store of blocks, such documents have at most the text of
+// DefaultField
+func (s *segmentFiles) legacyDocument(docId uint32) (*Document, error) {
+	if s.documents == nil {
+		return NewDocument(), nil
+	}
+
+	buf, err := s.documents.Get(uint32ToBytes(docId))
+	if err != nil {
+		return nil, err
+	}
+
+	doc := NewDocument()
+	if buf != nil {
+		doc.AddField(DefaultField, string(buf))
+	}
+	return doc, nil
+}
+
+func (s *segmentFiles) close() error {
+	err := s.postings.Close()
+	if s.documents == nil {
+		return err
+	}
+	if e := s.documents.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// readPostings reads postings of a term dictionary key from every segment,
+// positions are decoded only if withPositions is true
+func (d *diskIndex) readPostings(key string, withPositions bool) ([]Posting, error) {
+	result := make([]Posting, 0)
+
+	for _, s := range d.segments {
+		buf, err := s.postingList(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if buf == nil {
+			continue
+		}
+
+		postings, err := decodePostings(buf, s.format, withPositions)
+		if err != nil {
+			return nil, err
+		}
+		result = mergePostings(result, postings)
+	}
+
+	return result, nil
+}
+
+// document reads stored fields of a document from the segment holding it
+func (d *diskIndex) document(docId uint32) (*Document, error) {
+	for _, s := range d.segments {
+		if !s.docs.Contains(docId) {
+			continue
+		}
+
+		if s.documents == nil || s.unfielded {
+			return s.legacyDocument(docId)
+		}
+		return readDocument(s.documents, s.ordinal(docId))
+	}
+	return nil, ErrNotFound
+}
+
+func (d *diskIndex) close() error {
+	var err error
+	for _, s := range d.segments {
+		if e := s.close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// disk returns the files of the index opened for reading, they are opened
+// on first use and kept open until Close
+func (idx *InvertedIndex) disk() (*diskIndex, error) {
+	idx.filesMu.Lock()
+	defer idx.filesMu.Unlock()
+
+	if idx.closed {
+		return nil, ErrClosed
+	}
+
+	if idx.files == nil {
+		files, err := openDiskIndex(idx.dir, idx.segments, idx.memoryMap)
+		if err != nil {
+			return nil, err
+		}
+		idx.files = files
+	}
+
+	return idx.files, nil
+}
+
+// iterableSegments returns the files of the segments of a read only index
+// to read posting lists with postingIterator. It returns false if postings
+// are in memory or a segment was written before posting formats had blocks
+func (idx *InvertedIndex) iterableSegments() ([]*segmentFiles, bool, error) {
+	if !idx.readOnly || !idx.commited {
+		return nil, false, nil
+	}
+
+	files, err := idx.disk()
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, s := range files.segments {
+		if s.format == postingFormatRaw {
+			return nil, false, nil
+		}
+	}
+
+	return files.segments, true, nil
+}
+
+// closeDisk closes the files of the index opened for reading, they are
+// opened again when needed unless the index is closed
+func (idx *InvertedIndex) closeDisk() error {
+	idx.filesMu.Lock()
+	defer idx.filesMu.Unlock()
+
+	if idx.files == nil {
+		return nil
+	}
+
+	err := idx.files.close()
+	idx.files = nil
+
+	return err
+}
+
+// Close waits for background merges and releases files of the index opened
+// for searching, it waits for running searches. Searches reading from disk
+// fail with ErrClosed after Close, an index loaded into memory can still be
+// searched. The error that stopped background merges is returned if it was
+// not returned yet
+func (idx *InvertedIndex) Close() error {
+	idx.mu.Lock()
+	idx.closed = true
+	idx.mu.Unlock()
+
+	// merges check closed before starting and swap segments under the lock
+	mergeErr := idx.WaitForMerges()
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	err := idx.closeDisk()
+
+	// lookups in the metadata fail with ErrClosed like searches on disk
+	if idx.metadata != nil {
+		if e := idx.metadata.close(); err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	return mergeErr
+}
@@ -1 +1,33 @@
 package inverted
+
+// Field is a named value of a document
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Document is a collection of fields added to the index as a single unit,
+// a field name may be repeated to add multiple values to the same field
+type Document struct {
+	Fields []Field
+}
+
+func NewDocument() *Document {
+	return &Document{Fields: make([]Field, 0)}
+}
+
+// AddField appends a field value to the document
+func (d *Document) AddField(name, value string) *Document {
+	d.Fields = append(d.Fields, Field{name, value})
+	return d
+}
+
+// Get returns the first value of the named field or an empty string
+func (d *Document) Get(name string) string {
+	for _, f := range d.Fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package inverted
+
+import "errors"
+
+var (
+	// ErrReadOnly is returned when modifying an index opened in read only mode
+	ErrReadOnly = errors.New("index is in 'read only' mode")
+
+	// ErrCorruptIndex is returned when persisted index files cannot be decoded
+	ErrCorruptIndex = errors.New("index is corrupt")
+
+	// ErrNotFound is returned when a requested document or key does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrDuplicateId is returned when adding a document whose external id is
+	// already used by another document, use Update to replace it instead
+	ErrDuplicateId = errors.New("duplicate external id")
+
+	// ErrTooManyTerms is returned when a wildcard or regular expression
+	// query matches more terms than its maximum number of expansions
+	ErrTooManyTerms = errors.New("too many matching terms")
+
+	// ErrClosed is returned when reading files of an index after Close
+	ErrClosed = errors.New("index is closed")
+
+	// ErrIndexVersion is returned when opening index files written in a
+	// layout that cannot be read, the index has to be rebuilt
+	ErrIndexVersion = errors.New("unsupported index version")
+)
@@ -3,8 +3,10 @@ package inverted
 import (
 	"bufio"
 	"compress/gzip"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"unicode"
 
@@ -59,11 +61,22 @@ type turkishStemFilter struct {
 
 // NewTurkishStemFilter loads 1.087.312 Turkish words and their stems into a map
 // it uses a simple map lookup to find stem of a token, if any
-func NewTurkishStemFilter() TokenFilterer {
+func NewTurkishStemFilter() (TokenFilterer, error) {
+	return NewTurkishStemFilterFromFile(filepath.Join(DefaultIndexDir, "turkish_synonym.txt.gz"))
+}
+
+// NewTurkishStemFilterFromFile loads the Turkish stem dictionary from the given
+// gzipped file, each line of the file has the form "word=>stem"
+func NewTurkishStemFilterFromFile(path string) (TokenFilterer, error) {
+	dict, err := loadTurkishStems(path)
+	if err != nil {
+		return nil, err
+	}
+
 	filter := turkishStemFilter{}
-	filter.dict = loadTurkishStems()
+	filter.dict = dict
 	log.Println("Turkish stemmer dictionary loaded:", len(filter.dict), "items")
-	return filter
+	return filter, nil
 }
 
 func (tf turkishStemFilter) Filter(tokens []Token) []Token {
@@ -76,18 +89,17 @@ func (tf turkishStemFilter) Filter(tokens []Token) []Token {
 	return tokens
 }
 
-func loadTurkishStems() map[string]string {
+func loadTurkishStems(path string) (map[string]string, error) {
 
-	f, err := os.Open("data/turkish_synonym.txt.gz")
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatalln(err)
-		return nil
+		return nil, err
 	}
 	defer f.Close()
 
 	gr, err := gzip.NewReader(f)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer gr.Close()
 
@@ -95,15 +107,18 @@ func loadTurkishStems() map[string]string {
 
 	scanner := bufio.NewScanner(gr)
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), "=>")
+		line := strings.SplitN(scanner.Text(), "=>", 2)
+		if len(line) != 2 {
+			return nil, fmt.Errorf("%s: malformed stem entry %q", path, scanner.Text())
+		}
 		dict[line[0]] = line[1]
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return dict
+	return dict, nil
 }
 
 // LowercaseFilter lowercases all tokens
@@ -0,0 +1,248 @@
+package inverted
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// FuzzinessAuto selects the number of edits of fuzzy terms by term length
+const FuzzinessAuto = -1
+
+// defaultFuzzyExpansions is the number of dictionary terms a FuzzyQuery
+// expands to when MaxExpansions is not set
+const defaultFuzzyExpansions = 50
+
+// FuzzyQuery matches documents containing terms of a field within MaxEdits
+// insertions, deletions, substitutions or transpositions of Term. Each
+// matching term is scored like a TermQuery multiplied by 1/(1+edits)
+type FuzzyQuery struct {
+	Field string
+	Term  string
+
+	// MaxEdits is the maximum edit distance, FuzzinessAuto picks it by term length
+	MaxEdits int
+
+	// PrefixLength is the number of leading characters that must match exactly
+	PrefixLength int
+
+	// MaxExpansions limits the number of matching terms, the closest and
+	// most frequent terms are kept. Zero means 50
+	MaxExpansions int
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+// AutoFuzziness returns the number of edits allowed for a term, terms of up to
+// two characters must match exactly, up to five characters allow one edit
+// and longer terms two edits
+func AutoFuzziness(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	}
+	return 2
+}
+
+func (q *FuzzyQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	maxEdits := q.MaxEdits
+	if maxEdits == FuzzinessAuto {
+		maxEdits = AutoFuzziness(q.Term)
+	}
+
+	maxExpansions := q.MaxExpansions
+	if maxExpansions <= 0 {
+		maxExpansions = defaultFuzzyExpansions
+	}
+
+	matches := idx.expandFuzzy(q.Field, q.Term, maxEdits, q.PrefixLength)
+
+	// keep closest terms, then the most frequent ones
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].term.DocFreq > matches[j].term.DocFreq
+	})
+
+	if len(matches) > maxExpansions {
+		matches = matches[:maxExpansions]
+	}
+
+	var result []scoreDoc
+
+	for _, match := range matches {
+		postings, err := idx.termPostings(match.term.Value, false)
+		if err != nil {
+			return nil, err
+		}
+
+		scores := idx.scoreTerm(match.term.Value, postings)
+		result = unionScores(result, boostScores(scores, 1/float32(1+match.distance)))
+	}
+
+	return boostScores(result, q.Boost), nil
+}
+
+type fuzzyTerm struct {
+	term     Term
+	distance int
+}
+
+/*
+expandFuzzy returns dictionary terms of field within maxEdits of term.
+
+It runs a Levenshtein automaton, simulated with rows of the edit distance
+matrix, over the sorted term dictionary. Rows are kept for the characters
+a term shares with the previous term so only new characters are computed,
+and when every cell of a row exceeds maxEdits no term starting with the
+characters seen so far can match, all of them are skipped with a binary
+search instead of being scanned.
+*/
+func (idx *InvertedIndex) expandFuzzy(field, term string, maxEdits, prefixLength int) []fuzzyTerm {
+	query := []rune(term)
+	if prefixLength > len(query) {
+		prefixLength = len(query)
+	}
+	if prefixLength < 0 {
+		prefixLength = 0
+	}
+
+	key := fieldTerm(field, string(query[:prefixLength]))
+	query = query[prefixLength:]
+	terms := idx.expandPrefix(key)
+
+	matches := make([]fuzzyTerm, 0)
+	m := len(query)
+
+	// rows[d] holds edit distances between the first d characters
+	// of the dictionary term and every prefix of the query
+	first := make([]int, m+1)
+	for j := range first {
+		first[j] = j
+	}
+	rows := [][]int{first}
+
+	var prev []rune
+
+	for i := 0; i < len(terms); {
+		runes := []rune(terms[i].Value[len(key):])
+
+		common := 0
+		for common < len(prev) && common < len(runes) && prev[common] == runes[common] {
+			common++
+		}
+		if common > len(rows)-1 {
+			common = len(rows) - 1
+		}
+		rows = rows[:common+1]
+		prev = runes
+
+		dead := -1
+		for d := common; d < len(runes); d++ {
+			row := levenshteinRow(rows, runes, d, query)
+			rows = append(rows, row)
+
+			if minInt(row) > maxEdits {
+				dead = d + 1
+				break
+			}
+		}
+
+		if dead >= 0 {
+			// skip every term starting with the characters that cannot match
+			deadKey := key + string(runes[:dead])
+			i += sort.Search(len(terms)-i, func(k int) bool {
+				return !strings.HasPrefix(terms[i+k].Value, deadKey)
+			})
+			continue
+		}
+
+		if distance := rows[len(runes)][m]; distance <= maxEdits {
+			matches = append(matches, fuzzyTerm{terms[i], distance})
+		}
+		i++
+	}
+
+	return matches
+}
+
+// levenshteinRow computes the row of the edit distance matrix for the
+// character at depth d of a dictionary term, adjacent transpositions
+// count as a single edit
+func levenshteinRow(rows [][]int, runes []rune, d int, query []rune) []int {
+	prev := rows[d]
+	row := make([]int, len(query)+1)
+	row[0] = d + 1
+
+	for j := 1; j <= len(query); j++ {
+		cost := 1
+		if runes[d] == query[j-1] {
+			cost = 0
+		}
+
+		v := prev[j] + 1
+		if row[j-1]+1 < v {
+			v = row[j-1] + 1
+		}
+		if prev[j-1]+cost < v {
+			v = prev[j-1] + cost
+		}
+
+		if d > 0 && j > 1 && runes[d] == query[j-2] && runes[d-1] == query[j-1] && rows[d-1][j-2]+1 < v {
+			v = rows[d-1][j-2] + 1
+		}
+
+		row[j] = v
+	}
+
+	return row
+}
+
+func minInt(values []int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+// rewriteFuzzy returns a copy of a query where term queries of required and
+// optional clauses are replaced with fuzzy queries allowing edits, the
+// number of edits is chosen by term length if fuzziness is FuzzinessAuto
+func rewriteFuzzy(query Query, fuzziness int) Query {
+	switch q := query.(type) {
+	case *TermQuery:
+		edits := fuzziness
+		if edits == FuzzinessAuto {
+			edits = AutoFuzziness(q.Term)
+		}
+		if edits == 0 {
+			return q
+		}
+		return &FuzzyQuery{Field: q.Field, Term: q.Term, MaxEdits: edits, Boost: q.Boost}
+
+	case *BooleanQuery:
+		bq := *q
+		bq.Must = make([]Query, len(q.Must))
+		for i, clause := range q.Must {
+			bq.Must[i] = rewriteFuzzy(clause, fuzziness)
+		}
+		bq.Should = make([]Query, len(q.Should))
+		for i, clause := range q.Should {
+			bq.Should[i] = rewriteFuzzy(clause, fuzziness)
+		}
+		return &bq
+
+	case *proximityQuery:
+		// phrases always match exactly
+		return &proximityQuery{query: rewriteFuzzy(q.query, fuzziness), phrases: q.phrases}
+	}
+
+	return query
+}
@@ -85,7 +85,7 @@ func (hl *SpanHighlighter) HighlightParams(pre, post, spanDelimeter string, snip
 func (hl *SpanHighlighter) Highlight(document string, snippetSize int, query string) string {
 	index := NewInvertedIndex(hl.analyzer)
 
-	tokens := index.analyzer.Analyze(document)
+	tokens := hl.analyzer.Analyze(document)
 
 	snippets := make([]string, 0)
 
@@ -101,13 +101,14 @@ func (hl *SpanHighlighter) Highlight(document string, snippetSize int, query str
 
 	snippetMap := make(map[uint32]string)
 	for _, snippet := range snippets {
-		docId := index.Add(snippet, nil)
+		// snippets are added to a fresh in memory index which cannot fail
+		docId, _ := index.Add(snippet, nil)
 		snippetMap[docId] = snippet
 	}
 
 	index.UpdateAvgFieldLen()
 
-	hits := index.SearchOr(query)
+	hits, _ := index.SearchOr(query)
 
 	if len(hits) > 2 {
 		hits = hits[0:2]
@@ -1,8 +1,12 @@
 package inverted
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"sort"
+	"sync"
 
 	"github.com/RoaringBitmap/roaring"
 )
@@ -17,14 +21,86 @@ type Posting struct {
 type Term struct {
 	Value    string  // string representaion of the Term
 	Idf      float32 // Inverse Document Frequency of the Term
+	DocFreq  uint32  // number of documents containing the Term
+	MaxScore float32 // upper bound of the score of the Term in any document
+
+	// number of occurrences of the Term in all documents, it is set
+	// by MarshalIndex
+	TotalTermFreq uint64
+
 	Postings []Posting
 }
 
-// The main struct that represent an Inveted Index
+// DefaultIndexDir is the directory used by NewInvertedIndex and
+// NewInvertedIndexFromFile when no directory is given
+const DefaultIndexDir = "data"
+
+// Options controls how an index is created or opened
+type Options struct {
+	// Analyzer to use for text analysis and tokenization
+	Analyzer Analyzer
+
+	// Schema assigns analyzers to document fields, if nil a schema with
+	// only DefaultField analyzed by Analyzer is used
+	Schema *Schema
+
+	// CompressDocuments compresses stored fields in blocks of documents
+	CompressDocuments bool
+
+	// LoadIntoMemory loads all posting lists into memory when opening
+	// an existing index, otherwise postings are read from disk per query
+	LoadIntoMemory bool
+
+	// MemoryMap maps files of an existing index opened without
+	// LoadIntoMemory into memory, postings, stored fields, terms and
+	// external ids are decoded from the mapped bytes on demand and the
+	// operating system keeps the files in its page cache. Files are read
+	// into memory on platforms without memory mapping
+	MemoryMap bool
+
+	// Similarity scores fields without a Similarity in their FieldOptions,
+	// if nil DefaultSimilarity is used
+	Similarity Similarity
+
+	// MergePolicy selects segments merged in the background after every
+	// MarshalIndex, if nil segments are only merged by ForceMerge
+	MergePolicy MergePolicy
+}
+
+func (opts Options) schema() *Schema {
+	if opts.Schema != nil {
+		return opts.Schema
+	}
+	return NewSchema(DefaultField, opts.Analyzer)
+}
+
+// The main struct that represent an Inveted Index. It is safe for concurrent
+// use, searches run in parallel and see the index as it was when they started
+// while methods modifying the index wait for running searches and run alone.
+// NumDocs must not be read directly while documents are added or deleted
 type InvertedIndex struct {
+	// guards every field below, methods modifying the index hold the
+	// write lock and all others the read lock
+	mu sync.RWMutex
+
+	// guards building terms lazily under the read lock
+	termsMu sync.Mutex
+
+	// serializes MarshalIndex, which writes new segments without holding mu
+	commitMu sync.Mutex
+
+	// directory where index files are persisted
+	dir string
+
 	docId   uint32
 	NumDocs uint32
-	index   map[string][]Posting
+
+	// term dictionary, keys are field name and term joined by a colon
+	index map[string][]Posting
+
+	// term dictionary keys sorted by value with document frequencies, it is
+	// rebuilt from index when nil and loaded from disk for read only indexes
+	terms []Term
 
 	// document categories
 	docCategory map[string][]uint32
@@ -32,24 +108,95 @@ type InvertedIndex struct {
 	// roaring bitmaps to store bookCategory bitmaps
 	categoryBitmaps map[string]*roaring.Bitmap
 
-	// store field length in number of tokens
-	fieldLen []uint32
+	// deleted documents, their postings are removed from memory on the
+	// next MarshalIndex and from segments on disk when they are merged
+	deleted *roaring.Bitmap
 
-	// avarage field length
-	avgFieldLen float64
+	// deleted documents as of the last commit, merges remove only these so
+	// segments on disk always agree with the persisted metadata
+	committedDeleted *roaring.Bitmap
 
-	// Analyzer to use for text analysis and tokenization
-	analyzer Analyzer
+	// persisted segments of the index, the generation of the next segment
+	// and documents before flushed that are already in a segment
+	segments   []*segment
+	generation uint64
+	flushed    uint32
+
+	// selects segments to merge after MarshalIndex, nil disables merges
+	// in the background. mergeDone is closed when running merges stop,
+	// mergeErr is the error that stopped them until it is returned
+	mergePolicy MergePolicy
+	mergeDone   chan struct{}
+	mergeErr    error
+
+	// store field length in number of tokens for each field, it is
+	// loaded from disk only for indexes that can be modified
+	fieldLen map[string][]uint32
+
+	// field lengths encoded in a byte for scoring, see encodeNorm
+	norms map[string][]byte
+
+	// number of tokens of every field in live documents
+	sumFieldLen map[string]float64
+
+	// avarage field length for each field
+	avgFieldLen map[string]float64
+
+	// documents below lengthDocId are counted in sumFieldLen and
+	// avgFieldLen, documents added since are counted by UpdateAvgFieldLen
+	lengthDocId uint32
+
+	// Analyzers to use for text analysis and tokenization of each field
+	schema *Schema
+
+	// similarity of fields without their own, nil means DefaultSimilarity
+	similarity Similarity
+
+	// names of the similarities upper bounds of term scores in terms
+	// were computed with by MarshalIndex, by field
+	boundSimilarity map[string]string
+
+	// stored fields of documents, indexed by docId. It is nil when
+	// documents are read from the document store on disk
+	documents []*Document
+
+	// compress stored fields when persisting the document store
+	compressDocuments bool
+
+	// external ids of documents indexed by docId and the reverse lookup
+	// of live documents, external ids are values of the schema IDField
+	externalIds []string
+	docIds      map[string]uint32
 
 	// check if index is read only, means loaded from file
 	readOnly bool
 
+	// files of the index searched from disk, opened once and shared by
+	// searches until Close, filesMu guards opening them lazily
+	files   *diskIndex
+	filesMu sync.Mutex
+	closed  bool
+
+	// map files searched from disk into memory
+	memoryMap bool
+
+	// mapped metadata of an index searched from mapped files, external ids
+	// and terms are looked up in it instead of externalIds, docIds and terms
+	metadata *mappedMetadata
+
 	// Track if index is committed to disk
 	commited bool
 }
 
+// NewInvertedIndex creates an empty index persisted to DefaultIndexDir
+// with a single DefaultField analyzed by analyzer
 func NewInvertedIndex(analyzer Analyzer) *InvertedIndex {
+	return newInvertedIndex(DefaultIndexDir, NewSchema(DefaultField, analyzer))
+}
+
+func newInvertedIndex(dir string, schema *Schema) *InvertedIndex {
 	idx := &InvertedIndex{}
+	idx.dir = dir
 	idx.docId = 0
 
 	idx.index = make(map[string][]Posting)
@@ -59,10 +206,24 @@ func NewInvertedIndex(analyzer Analyzer) *InvertedIndex {
 
 	idx.categoryBitmaps = make(map[string]*roaring.Bitmap)
 
+	idx.deleted = roaring.NewBitmap()
+	idx.committedDeleted = roaring.NewBitmap()
+
+	idx.segments = make([]*segment, 0)
+	idx.generation = 1
+
 	// store field length in number of tokens
-	idx.fieldLen = make([]uint32, 0)
+	idx.fieldLen = make(map[string][]uint32)
+	idx.avgFieldLen = make(map[string]float64)
+	idx.sumFieldLen = make(map[string]float64)
+	idx.norms = make(map[string][]byte)
+
+	idx.schema = schema
 
-	idx.analyzer = analyzer
+	idx.documents = make([]*Document, 0)
+
+	idx.externalIds = make([]string, 0)
+	idx.docIds = make(map[string]uint32)
 
 	// this is an in memory index
 	idx.readOnly = false
@@ -73,79 +234,475 @@ func NewInvertedIndex(analyzer Analyzer) *InvertedIndex {
 
 }
 
-func (idx *InvertedIndex) Add(doc string, categories []string) uint32 {
+// Add adds text to the DefaultField of the schema as a new document
+func (idx *InvertedIndex) Add(doc string, categories []string) (uint32, error) {
+	return idx.AddDocument(NewDocument().AddField(idx.schema.DefaultField(), doc), categories)
+}
+
+// AddDocument analyzes every field of doc with the analyzer assigned by the
+// schema and adds it to the index, the new docId is returned
+func (idx *InvertedIndex) AddDocument(doc *Document, categories []string) (uint32, error) {
+	// analysis only reads the schema, searches are not blocked meanwhile
+	ad := idx.prepareDocument(doc, categories)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.addDocument(ad)
+}
+
+// errNilDocument is returned when adding a nil *Document
+var errNilDocument = errors.New("document is nil")
+
+// analyzedDocument is a document ready to be added to the index
+type analyzedDocument struct {
+	// positions of every term of each field and number of tokens of each field
+	positions map[string]map[string][]uint32
+	lengths   map[string]uint32
+
+	// stored fields, external id and categories of the document
+	stored     *Document
+	externalId string
+	categories []string
+
+	// the reason the document cannot be added if not nil
+	err error
+}
+
+// prepareDocument analyzes doc for addDocument, it does not access the index
+// and can run concurrently with any other method
+func (idx *InvertedIndex) prepareDocument(doc *Document, categories []string) *analyzedDocument {
+	ad := &analyzedDocument{categories: categories}
+
+	if doc == nil {
+		ad.err = errNilDocument
+		return ad
+	}
 
+	for _, f := range doc.Fields {
+		if !idx.schema.HasField(f.Name) {
+			ad.err = fmt.Errorf("field %q is not in the schema", f.Name)
+			return ad
+		}
+	}
+
+	if idField := idx.schema.IDField(); idField != "" {
+		ad.externalId = doc.Get(idField)
+	}
+
+	ad.positions = make(map[string]map[string][]uint32)
+	ad.lengths = make(map[string]uint32)
+	for field, tokens := range idx.analyzeDocument(doc) {
+		ad.positions[field] = tokenPositions(tokens)
+		ad.lengths[field] = uint32(len(tokens))
+	}
+
+	// keep original values of stored fields
+	ad.stored = NewDocument()
+	for _, f := range doc.Fields {
+		if idx.schema.IsStored(f.Name) {
+			ad.stored.AddField(f.Name, f.Value)
+		}
+	}
+
+	return ad
+}
+
+func (idx *InvertedIndex) addDocument(ad *analyzedDocument) (uint32, error) {
 	if idx.readOnly {
-		log.Fatalln("the index is in read only mode!")
+		return 0, ErrReadOnly
+	}
+
+	if ad.err != nil {
+		return 0, ad.err
+	}
+
+	if _, ok := idx.docIds[ad.externalId]; ok && ad.externalId != "" {
+		return 0, fmt.Errorf("%w: %q", ErrDuplicateId, ad.externalId)
 	}
 
 	// make sure if a document added to the index the state has changed
 	// to signal that the index needs to be persisted for future use
 	idx.commited = false
 
+	// sorted term dictionary has to be rebuilt
+	idx.terms = nil
+
 	// store docId as return value
 	docId := idx.docId
 
-	// Start the analysis process
-	tokens := idx.analyzer.Analyze(doc)
+	for field, positions := range ad.positions {
+		for key, val := range positions {
+			posting := Posting{docId, uint32(len(val)), 1.0, val}
+			key = fieldTerm(field, key)
+			idx.index[key] = append(idx.index[key], posting)
+		}
+
+		idx.setFieldLen(field, docId, ad.lengths[field])
+	}
+
+	idx.documents = append(idx.documents, ad.stored)
 
-	for key, val := range tokenPositions(tokens) {
-		//fmt.Println(key, val)
-		posting := Posting{idx.docId, uint32(len(val)), 1.0, val}
-		idx.index[key] = append(idx.index[key], posting)
+	idx.externalIds = append(idx.externalIds, ad.externalId)
+	if ad.externalId != "" {
+		idx.docIds[ad.externalId] = docId
 	}
 
 	// add document categories to index
-	for _, category := range categories {
-		idx.docCategory[category] = append(idx.docCategory[category], idx.docId)
+	for _, category := range ad.categories {
+		idx.docCategory[category] = append(idx.docCategory[category], docId)
 	}
 
 	// increment docId after ever document
 	idx.docId++
 
-	idx.fieldLen = append(idx.fieldLen, uint32(len(tokens)))
-
 	// increment total number of documents in index
 	idx.NumDocs++
 
-	return docId
+	return docId, nil
+}
+
+// analyzeDocument returns tokens of each field, positions of multiple values
+// of a field are kept apart so phrases do not match across values
+func (idx *InvertedIndex) analyzeDocument(doc *Document) map[string][]Token {
+	fields := make(map[string][]Token)
+
+	for _, f := range doc.Fields {
+		tokens := idx.schema.Analyzer(f.Name).Analyze(f.Value)
+
+		if prev := fields[f.Name]; len(prev) > 0 {
+			offset := prev[len(prev)-1].position + 2
+			for i := range tokens {
+				tokens[i].position += offset
+			}
+		}
+
+		fields[f.Name] = append(fields[f.Name], tokens...)
+	}
+
+	return fields
+}
+
+// Delete marks a document as deleted, it is excluded from search results
+// and index statistics immediately and purged on the next MarshalIndex
+func (idx *InvertedIndex) Delete(docId uint32) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.deleteDocument(docId)
+}
+
+func (idx *InvertedIndex) deleteDocument(docId uint32) error {
+	if idx.readOnly {
+		return ErrReadOnly
+	}
+
+	if docId >= idx.docId || idx.deleted.Contains(docId) {
+		return ErrNotFound
+	}
+
+	idx.deleted.Add(docId)
+	delete(idx.docIds, idx.externalIds[docId])
+	idx.NumDocs--
+	idx.removeFieldLen(docId)
+	idx.terms = nil
+	idx.commited = false
+
+	return nil
 }
 
+// Update replaces the document whose schema IDField is externalId with doc,
+// doc is added as a new document if no such document exists. If doc has no
+// value for the id field a copy of it with externalId is added, doc itself
+// is not changed. The index is not changed if doc cannot be added
+func (idx *InvertedIndex) Update(externalId string, doc *Document, categories []string) (uint32, error) {
+	idField := idx.schema.IDField()
+	if idField == "" {
+		return 0, errors.New("schema has no id field")
+	}
+
+	if doc == nil {
+		return 0, errNilDocument
+	}
+
+	if value := doc.Get(idField); value == "" {
+		fields := make([]Field, 0, len(doc.Fields)+1)
+		doc = &Document{Fields: append(fields, doc.Fields...)}
+		doc.AddField(idField, externalId)
+	} else if value != externalId {
+		return 0, fmt.Errorf("document id %q does not match external id %q", value, externalId)
+	}
+
+	// analyzed before the old document is deleted so it is kept if doc
+	// cannot be added
+	ad := idx.prepareDocument(doc, categories)
+	if ad.err != nil {
+		return 0, ad.err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if docId, ok := idx.docIds[externalId]; ok {
+		err := idx.deleteDocument(docId)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return idx.addDocument(ad)
+}
+
+// DocIdFor returns the docId of the live document with the given external id
+func (idx *InvertedIndex) DocIdFor(externalId string) (uint32, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	docId, ok, err := idx.lookupDocId(externalId)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return docId, nil
+}
+
+// lookupDocId finds the docId of the live document with an external id
+func (idx *InvertedIndex) lookupDocId(externalId string) (uint32, bool, error) {
+	if idx.metadata != nil {
+		return idx.metadata.docId(externalId)
+	}
+
+	docId, ok := idx.docIds[externalId]
+	return docId, ok, nil
+}
+
+// ExternalId returns the external id of a document
+func (idx *InvertedIndex) ExternalId(docId uint32) (string, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if docId >= idx.docId || idx.deleted.Contains(docId) {
+		return "", ErrNotFound
+	}
+
+	externalId, err := idx.externalId(docId)
+	if err != nil {
+		return "", err
+	}
+	if externalId == "" {
+		return "", ErrNotFound
+	}
+	return externalId, nil
+}
+
+// externalId returns the external id of a document, an empty string if it
+// has none
+func (idx *InvertedIndex) externalId(docId uint32) (string, error) {
+	if idx.metadata != nil {
+		return idx.metadata.externalId(docId)
+	}
+
+	if docId >= uint32(len(idx.externalIds)) {
+		return "", nil
+	}
+	return idx.externalIds[docId], nil
+}
+
+// IsDeleted reports whether a document has been deleted
+func (idx *InvertedIndex) IsDeleted(docId uint32) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.deleted.Contains(docId)
+}
+
+// removeDeleted returns postings of documents that are not deleted
+func (idx *InvertedIndex) removeDeleted(postings []Posting) []Posting {
+	if idx.deleted.IsEmpty() {
+		return postings
+	}
+
+	// postings may belong to the index, filter them into a new slice
+	live := make([]Posting, 0, len(postings))
+	for _, posting := range postings {
+		if !idx.deleted.Contains(posting.DocId) {
+			live = append(live, posting)
+		}
+	}
+	return live
+}
+
+// purgeDeleted removes postings and stored fields of deleted documents
+func (idx *InvertedIndex) purgeDeleted() {
+	if idx.deleted.IsEmpty() {
+		return
+	}
+
+	idx.terms = nil
+
+	for key, postings := range idx.index {
+		live := make([]Posting, 0, len(postings))
+		for _, posting := range postings {
+			if !idx.deleted.Contains(posting.DocId) {
+				live = append(live, posting)
+			}
+		}
+
+		if len(live) == 0 {
+			delete(idx.index, key)
+		} else {
+			idx.index[key] = live
+		}
+	}
+
+	for _, rb := range idx.categoryBitmaps {
+		rb.AndNot(idx.deleted)
+	}
+
+	iter := idx.deleted.Iterator()
+	for iter.HasNext() {
+		docId := iter.Next()
+		if int(docId) < len(idx.documents) {
+			idx.documents[docId] = NewDocument()
+		}
+	}
+}
+
+// Document returns stored fields of a document, fields that are not
+// stored in the schema are not returned
+func (idx *InvertedIndex) Document(docId uint32) (*Document, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if docId >= idx.docId || idx.deleted.Contains(docId) {
+		return nil, ErrNotFound
+	}
+
+	if idx.documents != nil {
+		return idx.documents[docId], nil
+	}
+
+	files, err := idx.disk()
+	if err != nil {
+		return nil, err
+	}
+
+	return files.document(docId)
+}
+
+// setFieldLen records the number of tokens of a field for docId, documents
+// without the field have zero length
+func (idx *InvertedIndex) setFieldLen(field string, docId, length uint32) {
+	fl := idx.fieldLen[field]
+	for uint32(len(fl)) < docId {
+		fl = append(fl, 0)
+	}
+	idx.fieldLen[field] = append(fl, length)
+
+	norms := idx.norms[field]
+	for uint32(len(norms)) < docId {
+		norms = append(norms, 0)
+	}
+	idx.norms[field] = append(norms, encodeNorm(length))
+}
+
+// UpdateAvgFieldLen calculates avarage length of each field
+// over the documents that have the field and are not deleted
 func (idx *InvertedIndex) UpdateAvgFieldLen() {
-	total := 0
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
 
-	for _, v := range idx.fieldLen {
-		total += int(v)
+	idx.updateAvgFieldLen()
+}
+
+// removeFieldLen subtracts lengths of the fields of a deleted document from
+// the length statistics if it is counted in them
+func (idx *InvertedIndex) removeFieldLen(docId uint32) {
+	if docId >= idx.lengthDocId {
+		return
 	}
 
-	idx.avgFieldLen = float64(total) / float64(idx.NumDocs)
+	for field, fl := range idx.fieldLen {
+		if docId >= uint32(len(fl)) || fl[docId] == 0 {
+			continue
+		}
+
+		// documents having the field, sums of lengths are exact
+		count := math.Round(idx.sumFieldLen[field] / idx.avgFieldLen[field])
+
+		idx.sumFieldLen[field] -= float64(fl[docId])
+		if count > 1 {
+			idx.avgFieldLen[field] = idx.sumFieldLen[field] / (count - 1)
+		} else {
+			idx.avgFieldLen[field] = 0
+		}
+	}
 }
 
-func (idx *InvertedIndex) scorePosting(postings []Posting) {
-	//fmt.Println(postings)
-	for i := range postings {
-		postings[i].Boost = float32(idf(float64(len(postings)), float64(idx.NumDocs)) * tf(float64(postings[i].frequency), float64(idx.fieldLen[postings[i].DocId]), idx.avgFieldLen))
-		//fmt.Println(postings[i].boost)
+func (idx *InvertedIndex) updateAvgFieldLen() {
+	idx.lengthDocId = idx.docId
+
+	for field, fl := range idx.fieldLen {
+		total := 0
+		count := 0
+
+		for docId, v := range fl {
+			if v > 0 && !idx.deleted.Contains(uint32(docId)) {
+				total += int(v)
+				count++
+			}
+		}
+
+		idx.sumFieldLen[field] = float64(total)
+
+		if count > 0 {
+			idx.avgFieldLen[field] = float64(total) / float64(count)
+		} else {
+			idx.avgFieldLen[field] = 0
+		}
 	}
-	//fmt.Println(postings)
 }
 
 func (idx *InvertedIndex) BuildCategoryBitmap() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.buildCategoryBitmap()
+}
 
+func (idx *InvertedIndex) buildCategoryBitmap() {
 	for k, v := range idx.docCategory {
-		rb := roaring.NewBitmap()
+		// keep bitmaps loaded from disk and add new documents to them
+		rb, ok := idx.categoryBitmaps[k]
+		if !ok {
+			rb = roaring.NewBitmap()
+			idx.categoryBitmaps[k] = rb
+		}
 		rb.AddMany(v)
-		idx.categoryBitmaps[k] = rb
+	}
+
+	for _, rb := range idx.categoryBitmaps {
+		rb.AndNot(idx.deleted)
 	}
 }
 
 func (idx *InvertedIndex) GetFacetCounts(postings []Posting) []FacetCount {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
 	facetCounts := make([]FacetCount, 0)
 
 	rb := roaring.NewBitmap()
 	for _, posting := range postings {
 		rb.Add(posting.DocId)
 	}
+	rb.AndNot(idx.deleted)
 
 	for k, v := range idx.categoryBitmaps {
 		fc := FacetCount{}
@@ -164,12 +721,14 @@ func (idx *InvertedIndex) GetFacetCounts(postings []Posting) []FacetCount {
 }
 
 func (idx *InvertedIndex) FacetFilter(postings []Posting, category string) []Posting {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 
 	result := make([]Posting, 0)
 	rb := idx.categoryBitmaps[category]
 
 	for _, posting := range postings {
-		if rb.Contains(posting.DocId) {
+		if rb.Contains(posting.DocId) && !idx.deleted.Contains(posting.DocId) {
 			result = append(result, posting)
 		}
 	}
@@ -177,15 +736,19 @@ func (idx *InvertedIndex) FacetFilter(postings []Posting, category string) []Pos
 }
 
 func (idx *InvertedIndex) Filter(category string) *roaring.Bitmap {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 
 	if val, ok := idx.categoryBitmaps[category]; ok {
-		return val.Clone()
+		return roaring.AndNot(val, idx.deleted)
 	}
 
 	return roaring.NewBitmap()
 }
 
 func (idx *InvertedIndex) TokenStats() []FacetCount {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 
 	stats := make([]FacetCount, 0)
 
@@ -218,6 +781,8 @@ func tokenPositions(tokens []Token) map[string][]uint32 {
 }
 
 func (idx *InvertedIndex) CalculateIndexSize() {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 
 	numPosting := 0
 	numPositions := 0
@@ -236,9 +801,10 @@ func (idx *InvertedIndex) CalculateIndexSize() {
 	log.Printf("ramPosting:%d, ramPositions:%d", ramPosting, ramPositions)
 }
 
+// AnalyzeText returns tokens of value analyzed as the default field
 func (idx *InvertedIndex) AnalyzeText(value string) []string {
 
-	tokens := idx.analyzer.Analyze(value)
+	tokens := idx.schema.Analyzer(idx.schema.DefaultField()).Analyze(value)
 	s := make([]string, 0)
 	for _, token := range tokens {
 		if token.value != "" {
@@ -249,25 +815,101 @@ func (idx *InvertedIndex) AnalyzeText(value string) []string {
 	return s
 }
 
+// Schema returns the schema used to analyze documents and queries
+func (idx *InvertedIndex) Schema() *Schema {
+	return idx.schema
+}
+
+// Dir returns the directory where the index is persisted
+func (idx *InvertedIndex) Dir() string {
+	return idx.dir
+}
+
 func (idx *InvertedIndex) IsReadOnly() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
 	return idx.readOnly
 }
 
 func (idx *InvertedIndex) SetReadOnly() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
 	idx.readOnly = true
 }
 
-func (idx *InvertedIndex) EnableLiveIndex() bool {
+// buildDocIds builds the reverse lookup of external ids of live documents
+func (idx *InvertedIndex) buildDocIds() {
+	idx.docIds = make(map[string]uint32)
+	for docId, externalId := range idx.externalIds {
+		if externalId != "" && !idx.deleted.Contains(uint32(docId)) {
+			idx.docIds[externalId] = uint32(docId)
+		}
+	}
+}
+
+// loadMappedMetadata loads external ids and terms of an index searched from
+// mapped files into memory and unmaps its metadata
+func (idx *InvertedIndex) loadMappedMetadata() error {
+	if idx.metadata == nil {
+		return nil
+	}
+
+	externalIds, err := idx.metadata.allExternalIds()
+	if err != nil {
+		return err
+	}
+
+	terms, err := idx.metadata.allTerms()
+	if err != nil {
+		return err
+	}
+
+	idx.externalIds = externalIds
+	idx.terms = terms
+	idx.buildDocIds()
+
+	err = idx.metadata.close()
+	idx.metadata = nil
+	return err
+}
+
+// EnableLiveIndex loads the term dictionary of a read only index into memory
+// so new documents can be added to it
+func (idx *InvertedIndex) EnableLiveIndex() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
 	if idx.readOnly {
-		termDictionary, err := loadTermDictionary()
+		termDictionary, err := idx.loadTermDictionary()
+		if err != nil {
+			return err
+		}
+
+		err = idx.loadMappedMetadata()
 		if err != nil {
-			log.Println("failed to load term dictionary and make index live")
-			return false
+			return err
+		}
+
+		documents, err := idx.loadDocuments()
+		if err != nil {
+			return err
+		}
+
+		fieldLen, err := loadFieldLen(idx.dir)
+		if err != nil {
+			return err
 		}
 
 		idx.index = termDictionary
+		idx.fieldLen = fieldLen
+		idx.documents = documents
 		idx.readOnly = false
+
+		// postings are read from memory until the index is opened again
+		return idx.closeDisk()
 	}
 
-	return true
+	return nil
 }
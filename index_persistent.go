@@ -1,72 +1,124 @@
 package inverted
 
 import (
-	"log"
-
-	"github.com/colinmarc/cdb"
+	"os"
 )
 
-func NewInvertedIndexFromFile(analyzer Analyzer, loadIntoMemory bool) *InvertedIndex {
-	idx := &InvertedIndex{}
-	idx.docId = 0
-
-	reader, err := cdb.Open("data/metadata.cdb")
+// Create creates a new empty index that will be persisted to dir,
+// the directory is created if it does not exist
+func Create(dir string, opts Options) (*InvertedIndex, error) {
+	err := os.MkdirAll(dir, 0755)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	defer reader.Close()
 
-	buf, err := reader.Get([]byte(":docId"))
+	idx := newInvertedIndex(dir, opts.schema())
+	idx.compressDocuments = opts.CompressDocuments
+	idx.similarity = opts.Similarity
+	idx.mergePolicy = opts.MergePolicy
+
+	return idx, nil
+}
+
+// Open opens an index previously persisted to dir with MarshalIndex, an
+// index searched from disk keeps its files open until Close
+func Open(dir string, opts Options) (*InvertedIndex, error) {
+	idx, err := openInvertedIndex(dir, opts.schema(), opts.LoadIntoMemory, opts.MemoryMap)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	idx.docId = bytesToUint32le(buf)
-	log.Printf("docId=%d\n", idx.docId)
+	idx.compressDocuments = opts.CompressDocuments
+	idx.similarity = opts.Similarity
+	idx.mergePolicy = opts.MergePolicy
 
-	buf, err = reader.Get([]byte(":NumDocs"))
+	return idx, nil
+}
+
+// NewInvertedIndexFromFile opens the index persisted to DefaultIndexDir
+// with a single DefaultField analyzed by analyzer
+func NewInvertedIndexFromFile(analyzer Analyzer, loadIntoMemory bool) (*InvertedIndex, error) {
+	return openInvertedIndex(DefaultIndexDir, NewSchema(DefaultField, analyzer), loadIntoMemory, false)
+}
+
+func openInvertedIndex(dir string, schema *Schema, loadIntoMemory, memoryMap bool) (*InvertedIndex, error) {
+	idx := &InvertedIndex{}
+	idx.dir = dir
+	idx.docId = 0
+	idx.memoryMap = memoryMap && !loadIntoMemory
+
+	err := idx.LoadIndexMetadata()
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	idx.NumDocs = bytesToUint32le(buf)
-	log.Printf("NumDocs=%d\n", idx.NumDocs)
 
-	buf, err = reader.Get([]byte(":avgFieldLen"))
+	// the metadata stays mapped only if the index is opened
+	opened := false
+	defer func() {
+		if !opened && idx.metadata != nil {
+			idx.metadata.close()
+		}
+	}()
+
+	idx.segments, idx.generation, err = loadSegments(dir)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
-	idx.avgFieldLen = bytesToFloat64(buf)
-	log.Printf("avgFieldLen=%f\n", idx.avgFieldLen)
 
-	buf, err = reader.Get([]byte(":fieldLen"))
-	if err != nil {
-		log.Println(err)
+	// documents added from now on are written as a new segment
+	idx.flushed = idx.docId
+	idx.committedDeleted = idx.deleted.Clone()
+
+	if idx.terms == nil && idx.metadata == nil {
+		idx.terms, err = idx.loadTerms()
+		if err != nil {
+			return nil, err
+		}
 	}
-	idx.fieldLen = deserializeFieldLen(buf)
 
 	if loadIntoMemory {
-		termDictionary, err := loadTermDictionary()
+		termDictionary, err := idx.loadTermDictionary()
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
 		idx.index = termDictionary
+
+		idx.documents, err = idx.loadDocuments()
+		if err != nil {
+			return nil, err
+		}
+
+		idx.fieldLen, err = loadFieldLen(dir)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	idx.categoryBitmaps, err = deserializeDocumentCategories()
+	idx.categoryBitmaps, err = deserializeDocumentCategories(dir)
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
 	}
 
-	// set analyzer
-	idx.analyzer = analyzer
+	// documents categories are kept for new documents added to a live index
+	idx.docCategory = make(map[string][]uint32)
+
+	// set analyzers of document fields
+	idx.schema = schema
 
 	if loadIntoMemory {
 		idx.readOnly = false
 	} else {
 		idx.readOnly = true
+
+		// files searched from disk are opened once for all searches
+		idx.files, err = openDiskIndex(dir, idx.segments, memoryMap)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// until a new document added to the index will be committed
 	idx.commited = true
+	opened = true
 
-	return idx
+	return idx, nil
 }
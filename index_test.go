@@ -0,0 +1,957 @@
+package inverted
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/colinmarc/cdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAnalyzer() Analyzer {
+	a := NewSimpleAnalyzer(NewSimpleTokenizer())
+	a.AddTokenFilter(NewLowercaseFilter())
+	return a
+}
+
+func TestIndexesInSeparateDirs(t *testing.T) {
+	opts := Options{Analyzer: newTestAnalyzer()}
+
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+
+	idx1, err := Create(dir1, opts)
+	assert.NoError(t, err)
+	_, err = idx1.Add("hello world", []string{"greeting"})
+	assert.NoError(t, err)
+	_, err = idx1.Add("goodbye world", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx1.MarshalIndex())
+
+	idx2, err := Create(dir2, opts)
+	assert.NoError(t, err)
+	_, err = idx2.Add("another world", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx2.MarshalIndex())
+
+	opts.LoadIntoMemory = true
+	loaded1, err := Open(dir1, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, dir1, loaded1.Dir())
+	assert.Len(t, search(t, loaded1, "world"), 2)
+	assert.Len(t, search(t, loaded1, "hello"), 1)
+
+	opts.LoadIntoMemory = false
+	loaded2, err := Open(dir2, opts)
+	assert.NoError(t, err)
+	hits, err := loaded2.Search_Mixed("world")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	hits, err = loaded2.Search_Mixed("hello")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 0)
+}
+
+func TestIndexErrors(t *testing.T) {
+	opts := Options{Analyzer: newTestAnalyzer()}
+	dir := t.TempDir()
+
+	_, err := Open(dir, opts)
+	assert.Error(t, err)
+
+	idx, err := Create(dir, opts)
+	assert.NoError(t, err)
+	_, err = idx.Add("hello world", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.MarshalIndex())
+
+	readOnly, err := Open(dir, opts)
+	assert.NoError(t, err)
+	_, err = readOnly.Add("hello again", nil)
+	assert.True(t, errors.Is(err, ErrReadOnly))
+	assert.True(t, errors.Is(readOnly.MarshalIndex(), ErrReadOnly))
+
+	_, err = ReadDocument_Cdb(dir, 5)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = deserializePostings([]byte{1, 2, 3})
+	assert.True(t, errors.Is(err, ErrCorruptIndex))
+}
+
+// rewriteMetadata rewrites metadata.cdb of the index in dir with the value
+// returned by edit for every key, keys edit returns nil for are dropped
+func rewriteMetadata(t *testing.T, dir string, edit func(key string, value []byte) []byte) {
+	path := filepath.Join(dir, "metadata.cdb")
+
+	reader, err := cdb.Open(path)
+	assert.NoError(t, err)
+	metadata := make(map[string][]byte)
+	iter := reader.Iter()
+	for iter.Next() {
+		metadata[string(iter.Key())] = append([]byte(nil), iter.Value()...)
+	}
+	assert.NoError(t, reader.Close())
+
+	writer, err := cdb.Create(path)
+	assert.NoError(t, err)
+	for key, value := range metadata {
+		if value = edit(key, value); value != nil {
+			assert.NoError(t, writer.Put([]byte(key), value))
+		}
+	}
+	assert.NoError(t, writer.Close())
+}
+
+func TestMetadataVersions(t *testing.T) {
+	opts := Options{Analyzer: newTestAnalyzer()}
+	dir := t.TempDir()
+	idx, err := Create(dir, opts)
+	assert.NoError(t, err)
+	for _, doc := range []string{"new york city", "york new", "old york", "paris"} {
+		_, err = idx.Add(doc, nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.Delete(1))
+	assert.NoError(t, idx.MarshalIndex())
+
+	want := search(t, idx, "new york")
+
+	// metadata added after fields is optional for unversioned indexes,
+	// statistics and the term dictionary are rebuilt
+	for _, dropped := range [][]string{
+		{":version", ":externalIds", ":terms", ":sumFieldLen:", ":norms:", ":similarity:"},
+		{":deleted"},
+	} {
+		rewriteMetadata(t, dir, func(key string, value []byte) []byte {
+			for _, prefix := range dropped {
+				if strings.HasPrefix(key, prefix) {
+					return nil
+				}
+			}
+			return value
+		})
+
+		for _, loadIntoMemory := range []bool{false, true} {
+			opts.LoadIntoMemory = loadIntoMemory
+			loaded, err := Open(dir, opts)
+			assert.NoError(t, err)
+			assert.Equal(t, want, search(t, loaded, "new york"))
+
+			term, ok := loaded.lookupTerm(fieldTerm(DefaultField, "york"))
+			assert.True(t, ok)
+			assert.Equal(t, uint32(2), term.DocFreq)
+			assert.Equal(t, uint64(2), term.TotalTermFreq)
+		}
+	}
+
+	assert.NoError(t, idx.MarshalIndex())
+	rewriteMetadata(t, dir, func(key string, value []byte) []byte {
+		if key == ":version" {
+			return uint32ToBytes(metadataVersion + 1)
+		}
+		return value
+	})
+	_, err = Open(dir, opts)
+	assert.True(t, errors.Is(err, ErrIndexVersion))
+}
+
+// writeBaselineIndex writes docs to dir in the layout of indexes written
+// before documents had fields and the index had segments
+func writeBaselineIndex(t *testing.T, dir string, docs []string) {
+	index := make(map[string][]Posting)
+	fieldLen := make([]uint32, len(docs))
+	documents, err := cdb.Create(filepath.Join(dir, "document.cdb"))
+	assert.NoError(t, err)
+
+	for docId, doc := range docs {
+		terms := strings.Fields(doc)
+		fieldLen[docId] = uint32(len(terms))
+
+		positions := make(map[string][]uint32)
+		for i, term := range terms {
+			positions[term] = append(positions[term], uint32(i))
+		}
+		for term, p := range positions {
+			index[term] = append(index[term], Posting{uint32(docId), uint32(len(p)), 1.0, p})
+		}
+		assert.NoError(t, documents.Put(uint32ToBytes(uint32(docId)), []byte(doc)))
+	}
+	assert.NoError(t, documents.Close())
+
+	postings, err := cdb.Create(filepath.Join(dir, "index.cdb"))
+	assert.NoError(t, err)
+	for term, p := range index {
+		assert.NoError(t, postings.Put([]byte(term), serializePostings(p)))
+	}
+	assert.NoError(t, postings.Close())
+
+	metadata, err := cdb.Create(filepath.Join(dir, "metadata.cdb"))
+	assert.NoError(t, err)
+	assert.NoError(t, metadata.Put([]byte(":docId"), uint32ToBytes(uint32(len(docs)))))
+	assert.NoError(t, metadata.Put([]byte(":NumDocs"), uint32ToBytes(uint32(len(docs)))))
+	assert.NoError(t, metadata.Put([]byte(":avgFieldLen"), float64ToBytes(8.0/3)))
+	assert.NoError(t, metadata.Put([]byte(":fieldLen"), serializeFieldLen(fieldLen)))
+	assert.NoError(t, metadata.Close())
+
+	categories, err := cdb.Create(filepath.Join(dir, "categories.cdb"))
+	assert.NoError(t, err)
+	assert.NoError(t, categories.Close())
+}
+
+func TestBaselineIndex(t *testing.T) {
+	opts := Options{Analyzer: newTestAnalyzer()}
+	dir := t.TempDir()
+	writeBaselineIndex(t, dir, []string{"new york city", "york new", "old york"})
+
+	check := func(york []uint32) {
+		for _, mode := range []Options{{LoadIntoMemory: true}, {}, {MemoryMap: true}} {
+			mode.Analyzer = opts.Analyzer
+			loaded, err := Open(dir, mode)
+			assert.NoError(t, err)
+			assert.Equal(t, york, postingIds(sortedById(search(t, loaded, "york"))))
+			assert.Len(t, search(t, loaded, "city"), 1)
+
+			postings, err := loaded.Execute(&PhraseQuery{Field: DefaultField, Terms: []string{"new", "york"}}, SearchOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, []uint32{0}, postingIds(postings))
+
+			term, ok := loaded.lookupTerm(fieldTerm(DefaultField, "york"))
+			assert.True(t, ok)
+			assert.Equal(t, uint32(len(york)), term.DocFreq)
+
+			doc, err := loaded.Document(1)
+			assert.NoError(t, err)
+			assert.Equal(t, "york new", doc.Get(DefaultField))
+			assert.NoError(t, loaded.Close())
+		}
+
+		postings, err := ReadPosting_Cdb(dir, fieldTerm(DefaultField, "york"))
+		assert.NoError(t, err)
+		assert.Equal(t, york, postingIds(postings))
+	}
+	check([]uint32{0, 1, 2})
+
+	// documents added to a baseline index are written as a new segment
+	opts.LoadIntoMemory = true
+	idx, err := Open(dir, opts)
+	assert.NoError(t, err)
+	_, err = idx.Add("york again", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.MarshalIndex())
+	check([]uint32{0, 1, 2, 3})
+
+	// merging rewrites the baseline segment with fields
+	assert.NoError(t, idx.ForceMerge())
+	assert.False(t, idx.segments[0].unfielded)
+	check([]uint32{0, 1, 2, 3})
+}
+
+func TestMultiFieldDocuments(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("title", FieldOptions{Analyzer: newTestAnalyzer()}))
+	assert.NoError(t, schema.AddField("id", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer())}))
+	assert.Error(t, schema.AddField("bad:name", FieldOptions{Analyzer: newTestAnalyzer()}))
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+
+	docs := []*Document{
+		NewDocument().AddField("id", "A-1").AddField("title", "Go programming").AddField("body", "a book about go"),
+		NewDocument().AddField("id", "B-2").AddField("title", "Cooking").AddField("body", "go and cook some programming pasta"),
+	}
+	for _, doc := range docs {
+		_, err = idx.AddDocument(doc, nil)
+		assert.NoError(t, err)
+	}
+
+	_, err = idx.AddDocument(NewDocument().AddField("unknown", "value"), nil)
+	assert.Error(t, err)
+
+	idx.UpdateAvgFieldLen()
+	assert.Len(t, search(t, idx, "programming"), 1)
+	assert.Len(t, search(t, idx, "title:programming"), 1)
+	assert.Equal(t, uint32(0), search(t, idx, "title:programming")[0].DocId)
+	assert.Len(t, search(t, idx, "id:B-2"), 1)
+	assert.Len(t, search(t, idx, "title:go book"), 1)
+	assert.Equal(t, 1.5, idx.avgFieldLen["title"])
+
+	assert.NoError(t, idx.MarshalIndex())
+	loaded, err := Open(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+	hits, err := loaded.Search_Mixed("title:cooking")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	assert.Equal(t, uint32(1), hits[0].DocId)
+	assert.Equal(t, idx.avgFieldLen, loaded.avgFieldLen)
+}
+
+func TestStoredDocuments(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		schema := NewSchema("body", newTestAnalyzer())
+		assert.NoError(t, schema.AddField("title", FieldOptions{Analyzer: newTestAnalyzer(), Stored: true}))
+
+		dir := t.TempDir()
+		opts := Options{Schema: schema, CompressDocuments: compress}
+		idx, err := Create(dir, opts)
+		assert.NoError(t, err)
+
+		for i := 0; i < 40; i++ {
+			doc := NewDocument().AddField("title", fmt.Sprintf("title %d", i)).AddField("body", "not stored")
+			_, err = idx.AddDocument(doc, nil)
+			assert.NoError(t, err)
+		}
+
+		doc, err := idx.Document(3)
+		assert.NoError(t, err)
+		assert.Equal(t, []Field{{"title", "title 3"}}, doc.Fields)
+
+		assert.NoError(t, idx.MarshalIndex())
+
+		readOnly, err := Open(dir, opts)
+		assert.NoError(t, err)
+		doc, err = readOnly.Document(37)
+		assert.NoError(t, err)
+		assert.Equal(t, "title 37", doc.Get("title"))
+		assert.Equal(t, "", doc.Get("body"))
+
+		_, err = readOnly.Document(40)
+		assert.True(t, errors.Is(err, ErrNotFound))
+
+		opts.LoadIntoMemory = true
+		live, err := Open(dir, opts)
+		assert.NoError(t, err)
+		doc, err = live.Document(16)
+		assert.NoError(t, err)
+		assert.Equal(t, "title 16", doc.Get("title"))
+	}
+}
+
+func TestDeleteAndUpdate(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("sku", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer()), Stored: true}))
+	assert.NoError(t, schema.SetIDField("sku"))
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+
+	for i, body := range []string{"red apple pie", "green apple", "red car"} {
+		_, err = idx.Update(fmt.Sprintf("sku-%d", i), NewDocument().AddField("body", body), []string{"color"})
+		assert.NoError(t, err)
+	}
+	idx.BuildCategoryBitmap()
+	idx.UpdateAvgFieldLen()
+
+	assert.NoError(t, idx.Delete(0))
+	assert.True(t, errors.Is(idx.Delete(0), ErrNotFound))
+	assert.Equal(t, uint32(2), idx.NumDocs)
+	assert.Len(t, search(t, idx, "apple"), 1)
+	assert.Equal(t, uint64(2), idx.Filter("color").GetCardinality())
+	assert.Equal(t, 2.0, idx.avgFieldLen["body"])
+
+	blue := NewDocument().AddField("body", "blue car")
+	newId, err := idx.Update("sku-2", blue, []string{"color"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), newId)
+	assert.Equal(t, "", blue.Get("sku"))
+
+	// lengths of deleted documents are subtracted, new documents are
+	// counted by UpdateAvgFieldLen
+	assert.Equal(t, 2.0, idx.sumFieldLen["body"])
+	assert.Equal(t, 2.0, idx.avgFieldLen["body"])
+	idx.UpdateAvgFieldLen()
+	assert.Equal(t, 4.0, idx.sumFieldLen["body"])
+	assert.Len(t, search(t, idx, "red"), 0)
+	assert.Len(t, search(t, idx, "blue"), 1)
+
+	// a failed update leaves the old document in place
+	_, err = idx.Update("sku-2", NewDocument().AddField("body", "green car").AddField("price", "10"), nil)
+	assert.Error(t, err)
+	assert.Len(t, search(t, idx, "blue"), 1)
+	docId, err := idx.DocIdFor("sku-2")
+	assert.NoError(t, err)
+	assert.Equal(t, newId, docId)
+
+	doc, err := idx.Document(newId)
+	assert.NoError(t, err)
+	assert.Equal(t, "sku-2", doc.Get("sku"))
+	_, err = idx.Document(2)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	assert.NoError(t, idx.MarshalIndex())
+	_, ok := idx.index["body:red"]
+	assert.False(t, ok)
+
+	loaded, err := Open(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), loaded.NumDocs)
+	assert.True(t, loaded.IsDeleted(0))
+	hits, err := loaded.Search_Mixed("car")
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	assert.Equal(t, newId, hits[0].DocId)
+	assert.Equal(t, []FacetCount{{"color", 2}}, loaded.GetFacetCounts([]Posting{{DocId: 0}, {DocId: 1}, {DocId: 3}}))
+}
+
+func TestExternalIds(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("sku", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer())}))
+	assert.NoError(t, schema.SetIDField("sku"))
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+
+	_, err = idx.AddDocument(NewDocument().AddField("sku", "A-1").AddField("body", "red apple"), nil)
+	assert.NoError(t, err)
+	_, err = idx.AddDocument(NewDocument().AddField("sku", "A-1").AddField("body", "green apple"), nil)
+	assert.True(t, errors.Is(err, ErrDuplicateId))
+	_, err = idx.Update("B-2", NewDocument().AddField("body", "green apple"), nil)
+	assert.NoError(t, err)
+	_, err = idx.Update("A-1", NewDocument().AddField("body", "yellow apple"), nil)
+	assert.NoError(t, err)
+
+	docId, err := idx.DocIdFor("A-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), docId)
+	_, err = idx.ExternalId(0)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	assert.NoError(t, idx.MarshalIndex())
+	loaded, err := Open(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+
+	extId, err := loaded.ExternalId(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "B-2", extId)
+	docId, err = loaded.DocIdFor("A-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), docId)
+
+	postings, err := loaded.Search_Mixed("yellow")
+	assert.NoError(t, err)
+	hits := loaded.Hits(postings)
+	assert.Len(t, hits, 1)
+	assert.Equal(t, "A-1", hits[0].ExternalId)
+}
+
+func TestAddBatch(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("sku", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer())}))
+	assert.NoError(t, schema.SetIDField("sku"))
+
+	docs := make([]BatchDocument, 0)
+	for i := 0; i < 40; i++ {
+		doc := NewDocument().AddField("sku", fmt.Sprintf("sku-%d", i%30)).AddField("body", fmt.Sprintf("item %d red apple", i))
+		docs = append(docs, BatchDocument{doc, []string{fmt.Sprint(i % 3)}})
+	}
+	docs[5].Document.AddField("author", "nobody")
+	docs[7].Document = nil
+
+	idx, err := Create(t.TempDir(), Options{Schema: schema})
+	assert.NoError(t, err)
+
+	done := make([]int, 0)
+	results := idx.AddBatch(docs, BatchOptions{Workers: 4, Progress: func(n, total int) {
+		assert.Equal(t, len(docs), total)
+		done = append(done, n)
+	}})
+	assert.Len(t, done, len(docs))
+	assert.Equal(t, len(docs), done[len(done)-1])
+
+	// documents are added in batch order like with AddDocument
+	sequential, err := Create(t.TempDir(), Options{Schema: schema})
+	assert.NoError(t, err)
+	for i, doc := range docs {
+		docId, err := sequential.AddDocument(doc.Document, doc.Categories)
+		assert.Equal(t, err, results[i].Err, i)
+		if err == nil {
+			assert.Equal(t, docId, results[i].DocId, i)
+		}
+	}
+
+	assert.Error(t, results[5].Err)
+	assert.Error(t, results[7].Err)
+	assert.True(t, errors.Is(results[30].Err, ErrDuplicateId))
+	assert.Equal(t, uint32(30), idx.NumDocs)
+	assert.Equal(t, sequential.index, idx.index)
+	assert.Equal(t, sequential.docCategory, idx.docCategory)
+
+	_, err = idx.DocIdFor("sku-29")
+	assert.NoError(t, err)
+}
+
+func TestPostingFormats(t *testing.T) {
+	postings := make([]Posting, 0)
+	docId := uint32(0)
+	for i := 0; i < 300; i++ {
+		docId += uint32(i%7) + 1
+		positions := []uint32{uint32(i % 5)}
+		if i%3 == 0 {
+			positions = append(positions, uint32(i%5)+4, 1000)
+		}
+		postings = append(postings, Posting{docId, uint32(len(positions)), 1.0, positions})
+	}
+
+	encoded := encodePostings(postings)
+	assert.Less(t, len(encoded)*3, len(serializePostings(postings)))
+
+	decoded, err := decodePostings(encoded, postingFormat, true)
+	assert.NoError(t, err)
+	assert.Equal(t, postings, decoded)
+
+	decoded, err = decodePostings(encoded, postingFormat, false)
+	assert.NoError(t, err)
+	assert.Len(t, decoded, len(postings))
+	assert.Equal(t, postings[299].DocId, decoded[299].DocId)
+	assert.Equal(t, postings[297].frequency, decoded[297].frequency)
+	assert.Nil(t, decoded[297].positions)
+
+	_, err = decodePostings(encoded[:len(encoded)/2], postingFormat, true)
+	assert.True(t, errors.Is(err, ErrCorruptIndex))
+
+	// Advance skips whole blocks and keeps positions of later postings
+	it, err := newPostingIterator(encoded, postingFormat)
+	assert.NoError(t, err)
+	for _, k := range []int{0, 1, 130, 131, 290} {
+		assert.True(t, it.Advance(postings[k].DocId-1), k)
+		assert.Equal(t, postings[k].DocId, it.DocId(), k)
+		assert.Equal(t, postings[k].positions, it.Positions(), k)
+	}
+	assert.Equal(t, 3, it.block)
+	assert.True(t, it.Advance(postings[290].DocId))
+	assert.Equal(t, postings[290].DocId, it.DocId())
+	assert.False(t, it.Advance(postings[299].DocId+1))
+	assert.NoError(t, it.Err())
+
+	// index files written before posting formats were versioned still load
+	opts := Options{Analyzer: newTestAnalyzer()}
+	dir := t.TempDir()
+	idx, err := Create(dir, opts)
+	assert.NoError(t, err)
+	for _, doc := range []string{"new york city", "york new", "old york"} {
+		_, err = idx.Add(doc, nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.MarshalIndex())
+
+	check := func() {
+		for _, loadIntoMemory := range []bool{false, true} {
+			opts.LoadIntoMemory = loadIntoMemory
+			loaded, err := Open(dir, opts)
+			assert.NoError(t, err)
+			assert.Len(t, search(t, loaded, "york"), 3)
+
+			postings, err := loaded.Execute(&PhraseQuery{Field: DefaultField, Terms: []string{"new", "york"}}, SearchOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, []uint32{0}, postingIds(postings))
+		}
+
+		postings, err := ReadPosting_Cdb(dir, fieldTerm(DefaultField, "york"))
+		assert.NoError(t, err)
+		assert.Equal(t, []uint32{0, 1, 2}, postingIds(postings))
+	}
+	check()
+
+	// indexes of metadata version 1 list their segments in segmentsFile
+	writer, err := cdb.Create(filepath.Join(dir, segmentsFile))
+	assert.NoError(t, err)
+	rewriteMetadata(t, dir, func(key string, value []byte) []byte {
+		switch key {
+		case ":generation", ":segments":
+			assert.NoError(t, writer.Put([]byte(key), value))
+			return nil
+		case ":version":
+			return uint32ToBytes(1)
+		}
+		return value
+	})
+	assert.NoError(t, writer.Close())
+	check()
+
+	// indexes written before segments have a single index.cdb and document.cdb
+	assert.NoError(t, os.Remove(filepath.Join(dir, segmentsFile)))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "index_1.cdb")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "document_1.cdb"), filepath.Join(dir, "document.cdb")))
+
+	writer, err = cdb.Create(filepath.Join(dir, "index.cdb"))
+	assert.NoError(t, err)
+	for k, v := range idx.index {
+		assert.NoError(t, writer.Put([]byte(k), serializePostings(v)))
+	}
+	assert.NoError(t, writer.Close())
+	check()
+}
+
+func TestClose(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("body", FieldOptions{Analyzer: newTestAnalyzer(), Stored: true}))
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+	_, err = idx.Add("hello world", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.MarshalIndex())
+
+	readOnly, err := Open(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		hits, err := readOnly.Search_Mixed("hello")
+		assert.NoError(t, err)
+		assert.Len(t, hits, 1)
+		doc, err := readOnly.Document(0)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello world", doc.Get("body"))
+	}
+
+	assert.NoError(t, readOnly.Close())
+	assert.NoError(t, readOnly.Close())
+	_, err = readOnly.Search_Mixed("hello")
+	assert.True(t, errors.Is(err, ErrClosed))
+	_, err = readOnly.Document(0)
+	assert.True(t, errors.Is(err, ErrClosed))
+
+	// an index made live again no longer needs its files
+	live, err := Open(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+	assert.NoError(t, live.EnableLiveIndex())
+	assert.Nil(t, live.files)
+	_, err = live.Add("hello again", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, live.MarshalIndex())
+	assert.Len(t, search(t, live, "hello"), 2)
+	assert.NoError(t, live.Close())
+	assert.Len(t, search(t, live, "hello"), 2)
+}
+
+func TestMemoryMappedIndex(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("body", FieldOptions{Analyzer: newTestAnalyzer(), Stored: true}))
+	assert.NoError(t, schema.AddField("id", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer())}))
+	assert.NoError(t, schema.SetIDField("id"))
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: schema, CompressDocuments: true})
+	assert.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		doc := NewDocument().AddField("body", fmt.Sprintf("new york %d", i%7))
+		if i%3 == 0 {
+			doc.AddField("id", fmt.Sprintf("doc-%d", i))
+		}
+		_, err = idx.AddDocument(doc, nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.Delete(3))
+	assert.NoError(t, idx.MarshalIndex())
+
+	// every key of a file is found like with the cdb package
+	reader, err := cdb.Open(filepath.Join(dir, "metadata.cdb"))
+	assert.NoError(t, err)
+	mapped, err := openMappedCDB(filepath.Join(dir, "metadata.cdb"))
+	assert.NoError(t, err)
+	iter := reader.Iter()
+	for iter.Next() {
+		value, err := mapped.Get(iter.Key())
+		assert.NoError(t, err)
+		assert.Equal(t, iter.Value(), value, string(iter.Key()))
+	}
+	value, err := mapped.Get([]byte("missing"))
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+	assert.NoError(t, reader.Close())
+	assert.NoError(t, mapped.Close())
+
+	inMemory, err := Open(dir, Options{Schema: schema, LoadIntoMemory: true})
+	assert.NoError(t, err)
+	memoryMapped, err := Open(dir, Options{Schema: schema, MemoryMap: true})
+	assert.NoError(t, err)
+
+	check := func() {
+		for _, q := range []string{"york", "new york 3", `"york 5"`, "body:ne*"} {
+			want, err := inMemory.SearchQuery(q)
+			assert.NoError(t, err)
+			got, err := memoryMapped.SearchQuery(q)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got, q)
+		}
+
+		doc, err := memoryMapped.Document(299)
+		assert.NoError(t, err)
+		assert.Equal(t, "new york 5", doc.Get("body"))
+
+		// external ids and terms are looked up in the mapped metadata
+		assert.Nil(t, memoryMapped.externalIds)
+		assert.Nil(t, memoryMapped.terms)
+		for _, docId := range []uint32{0, 1, 3, 6, 297, 299} {
+			want, wantErr := inMemory.ExternalId(docId)
+			got, err := memoryMapped.ExternalId(docId)
+			assert.Equal(t, want, got, docId)
+			assert.Equal(t, wantErr, err, docId)
+		}
+		for _, externalId := range []string{"doc-0", "doc-3", "doc-297", "missing"} {
+			want, wantErr := inMemory.DocIdFor(externalId)
+			got, err := memoryMapped.DocIdFor(externalId)
+			assert.Equal(t, want, got, externalId)
+			assert.Equal(t, wantErr, err, externalId)
+		}
+		assert.Equal(t, inMemory.expandPrefix("body:"), memoryMapped.expandPrefix("body:"))
+		assert.Equal(t, inMemory.termDictionary(), memoryMapped.termDictionary())
+		_, ok := memoryMapped.lookupTerm("body:yor")
+		assert.False(t, ok)
+	}
+	check()
+
+	// segment files removed by merges stay readable by the mapped index
+	_, err = idx.Add("new york 8", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.MarshalIndex())
+	assert.NoError(t, idx.ForceMerge())
+	check()
+
+	assert.NoError(t, memoryMapped.Close())
+	_, err = memoryMapped.SearchQuery("york")
+	assert.True(t, errors.Is(err, ErrClosed))
+	_, err = memoryMapped.DocIdFor("doc-0")
+	assert.True(t, errors.Is(err, ErrClosed))
+
+	// a live index loads external ids and terms from the mapped metadata
+	live, err := Open(dir, Options{Schema: schema, MemoryMap: true})
+	assert.NoError(t, err)
+	assert.NoError(t, live.EnableLiveIndex())
+	assert.Nil(t, live.metadata)
+	docId, err := live.DocIdFor("doc-297")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(297), docId)
+	_, ok := live.lookupTerm("body:york")
+	assert.True(t, ok)
+	assert.NoError(t, live.Close())
+}
+
+func TestSegments(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("body", FieldOptions{Analyzer: newTestAnalyzer(), Stored: true}))
+	assert.NoError(t, schema.AddField("id", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer()), Stored: true}))
+	assert.NoError(t, schema.SetIDField("id"))
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: schema})
+	assert.NoError(t, err)
+
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			doc := NewDocument()
+			doc.AddField("id", fmt.Sprintf("doc-%d", i))
+			doc.AddField("body", fmt.Sprintf("new york %d", i%7))
+			_, err := idx.AddDocument(doc, nil)
+			assert.NoError(t, err)
+		}
+	}
+
+	// every commit writes documents added since the previous one
+	for commit := 0; commit < 3; commit++ {
+		add(commit*200, (commit+1)*200)
+		assert.NoError(t, idx.MarshalIndex())
+	}
+	assert.NoError(t, idx.MarshalIndex())
+
+	segments := idx.Segments()
+	assert.Len(t, segments, 3)
+	for i, s := range segments {
+		assert.Equal(t, uint64(i+1), s.Generation)
+		assert.Equal(t, 200, s.NumDocs)
+		assert.Equal(t, 0, s.NumDeleted)
+	}
+
+	for docId := uint32(10); docId < 300; docId += 10 {
+		assert.NoError(t, idx.Delete(docId))
+	}
+	doc := NewDocument()
+	doc.AddField("id", "doc-5")
+	doc.AddField("body", "old york")
+	_, err = idx.Update("doc-5", doc, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, idx.MarshalIndex())
+
+	segments = idx.Segments()
+	assert.Len(t, segments, 4)
+	assert.Equal(t, 20, segments[0].NumDeleted)
+	assert.Equal(t, 10, segments[1].NumDeleted)
+	assert.Equal(t, 1, segments[3].NumDocs)
+
+	// searches on disk fan out over segments like the index in memory
+	check := func() {
+		onDisk, err := Open(dir, Options{Schema: schema})
+		assert.NoError(t, err)
+		defer onDisk.Close()
+		assert.Equal(t, idx.Segments(), onDisk.Segments())
+
+		for _, q := range []string{"york", "new york 3", `"new york"`, "old", "body:ne*"} {
+			want, err := idx.SearchQuery(q)
+			assert.NoError(t, err)
+			got, err := onDisk.SearchQuery(q)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got, q)
+		}
+
+		for _, docId := range []uint32{0, 199, 201, 450, 600} {
+			want, err := idx.Document(docId)
+			assert.NoError(t, err)
+			got, err := onDisk.Document(docId)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got, docId)
+		}
+
+		_, err = onDisk.Document(10)
+		assert.True(t, errors.Is(err, ErrNotFound))
+	}
+	check()
+
+	assert.NoError(t, idx.ForceMerge())
+
+	segments = idx.Segments()
+	assert.Len(t, segments, 1)
+	assert.Equal(t, uint64(5), segments[0].Generation)
+	assert.Equal(t, 601-30, segments[0].NumDocs)
+	assert.Equal(t, 0, segments[0].NumDeleted)
+
+	// merged segments are removed
+	_, err = os.Stat(filepath.Join(dir, "index_1.cdb"))
+	assert.True(t, os.IsNotExist(err))
+	check()
+
+	postings, err := ReadPosting_Cdb(dir, "body:old")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{600}, postingIds(postings))
+
+	doc, err = ReadDocument_Cdb(dir, 600)
+	assert.NoError(t, err)
+	assert.Equal(t, "old york", doc.Get("body"))
+}
+
+func TestMergePolicies(t *testing.T) {
+	segments := func(sizes ...int64) []SegmentInfo {
+		infos := make([]SegmentInfo, len(sizes))
+		for i, size := range sizes {
+			infos[i] = SegmentInfo{Generation: uint64(i + 1), NumDocs: 10, Size: size}
+		}
+		return infos
+	}
+
+	generations := func(merges [][]SegmentInfo) [][]uint64 {
+		result := make([][]uint64, 0)
+		for _, group := range merges {
+			gens := make([]uint64, 0)
+			for _, s := range group {
+				gens = append(gens, s.Generation)
+			}
+			result = append(result, gens)
+		}
+		return result
+	}
+
+	logPolicy := &LogByteSizeMergePolicy{MergeFactor: 3, MinMergeSize: 100}
+	assert.Equal(t, [][]uint64{{1, 2, 3}, {4, 5, 6}}, generations(logPolicy.FindMerges(segments(10, 10, 10, 10, 10, 10, 10))))
+
+	// segments of a higher level are not merged with smaller ones
+	assert.Equal(t, [][]uint64{{2, 3, 4}}, generations(logPolicy.FindMerges(segments(10000, 10, 20, 10))))
+	assert.Empty(t, logPolicy.FindMerges(segments(10000, 10, 10)))
+
+	tiered := &TieredMergePolicy{SegmentsPerTier: 4, MaxMergeAtOnce: 4, FloorSegmentSize: 100}
+	assert.Empty(t, tiered.FindMerges(segments(100, 100, 100, 100)))
+
+	merges := tiered.FindMerges(segments(100, 100, 100, 100, 100, 100, 100, 100, 100, 100))
+	assert.NotEmpty(t, merges)
+	merged := make(map[uint64]bool)
+	for _, group := range merges {
+		assert.True(t, len(group) >= 2 && len(group) <= 4)
+		for _, s := range group {
+			assert.False(t, merged[s.Generation])
+			merged[s.Generation] = true
+		}
+	}
+
+	// segments of similar sizes are merged first
+	tiered = &TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2, FloorSegmentSize: 100}
+	assert.Equal(t, [][]uint64{{2, 5}}, generations(tiered.FindMerges(segments(400, 100, 120, 110, 100, 130))))
+
+	// segments with too many deleted documents are rewritten
+	infos := segments(100, 100)
+	infos[1].NumDeleted = 5
+	assert.Equal(t, [][]uint64{{2}}, generations(tiered.FindMerges(infos)))
+}
+
+func TestBackgroundMerges(t *testing.T) {
+	policies := []MergePolicy{
+		&LogByteSizeMergePolicy{MergeFactor: 2},
+		&TieredMergePolicy{SegmentsPerTier: 2, MaxMergeAtOnce: 2},
+	}
+
+	for _, policy := range policies {
+		dir := t.TempDir()
+		idx, err := Create(dir, Options{Analyzer: newTestAnalyzer(), MergePolicy: policy})
+		assert.NoError(t, err)
+
+		for commit := 0; commit < 8; commit++ {
+			for i := 0; i < 10; i++ {
+				_, err = idx.Add(fmt.Sprintf("new york %d", commit), nil)
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, idx.MarshalIndex())
+			assert.Len(t, search(t, idx, "york"), (commit+1)*10)
+		}
+
+		// small segments are merged into a few ones
+		assert.NoError(t, idx.WaitForMerges())
+		assert.True(t, len(idx.Segments()) <= 3, "%T: %v", policy, idx.Segments())
+
+		onDisk, err := Open(dir, Options{Analyzer: newTestAnalyzer()})
+		assert.NoError(t, err)
+		assert.Len(t, search(t, onDisk, "york"), 80)
+		assert.NoError(t, onDisk.Close())
+
+		assert.NoError(t, idx.Close())
+	}
+
+	// deleted documents are reclaimed in the background
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Analyzer: newTestAnalyzer(), MergePolicy: &TieredMergePolicy{DeletesPctAllowed: 10}})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = idx.Add("new york", nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.MarshalIndex())
+	assert.NoError(t, idx.Delete(3))
+	assert.NoError(t, idx.Delete(4))
+	assert.NoError(t, idx.MarshalIndex())
+
+	assert.NoError(t, idx.WaitForMerges())
+	segments := idx.Segments()
+	assert.Len(t, segments, 1)
+	assert.Equal(t, 8, segments[0].NumDocs)
+	assert.Equal(t, 0, segments[0].NumDeleted)
+	assert.NoError(t, idx.Close())
+
+	// errors of background merges are returned once
+	dir = t.TempDir()
+	idx, err = Create(dir, Options{Analyzer: newTestAnalyzer(), MergePolicy: &LogByteSizeMergePolicy{MergeFactor: 2}})
+	assert.NoError(t, err)
+	for commit := 0; commit < 2; commit++ {
+		if commit == 1 {
+			assert.NoError(t, os.Remove(filepath.Join(dir, idx.segments[0].postingsFile())))
+		}
+		_, err = idx.Add("new york", nil)
+		assert.NoError(t, err)
+		assert.NoError(t, idx.MarshalIndex())
+	}
+	assert.Error(t, idx.WaitForMerges())
+	assert.NoError(t, idx.WaitForMerges())
+	assert.Len(t, idx.Segments(), 2)
+	assert.NoError(t, idx.Close())
+}
@@ -0,0 +1,418 @@
+package inverted
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Segments returns the persisted segments of the index ordered by
+// generation, documents added since the last MarshalIndex are in none
+func (idx *InvertedIndex) Segments() []SegmentInfo {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.segmentInfos()
+}
+
+func (idx *InvertedIndex) segmentInfos() []SegmentInfo {
+	infos := make([]SegmentInfo, 0, len(idx.segments))
+	for _, s := range idx.segments {
+		infos = append(infos, SegmentInfo{
+			Generation: s.gen,
+			NumDocs:    int(s.docs.GetCardinality()),
+			NumDeleted: int(s.docs.AndCardinality(idx.committedDeleted)),
+			Size:       s.size,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Generation < infos[j].Generation })
+
+	return infos
+}
+
+// ForceMerge merges all segments of the index into a single segment without
+// documents deleted before the last MarshalIndex. Documents can be added and
+// searched while segments are merged, segments merged in the background
+// meanwhile are left as they are
+func (idx *InvertedIndex) ForceMerge() error {
+	idx.mu.RLock()
+
+	if idx.readOnly {
+		idx.mu.RUnlock()
+		return ErrReadOnly
+	}
+
+	segments := append([]*segment(nil), idx.segments...)
+	deleted := idx.committedDeleted.Clone()
+
+	idx.mu.RUnlock()
+
+	if len(segments) == 0 || len(segments) == 1 && !segments[0].docs.Intersects(deleted) {
+		return nil
+	}
+
+	return idx.mergeSegments(segments, deleted)
+}
+
+// WaitForMerges waits until merges running in the background are done, it
+// returns the error that stopped them if it was not returned yet
+func (idx *InvertedIndex) WaitForMerges() error {
+	idx.mu.RLock()
+	done := idx.mergeDone
+	idx.mu.RUnlock()
+
+	if done != nil {
+		<-done
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.takeMergeErr()
+}
+
+// takeMergeErr returns the error that stopped background merges once
+func (idx *InvertedIndex) takeMergeErr() error {
+	err := idx.mergeErr
+	idx.mergeErr = nil
+	return err
+}
+
+// maybeMerge starts merging segments selected by the merge policy in the
+// background unless merges are already running
+func (idx *InvertedIndex) maybeMerge() {
+	if idx.mergePolicy == nil || idx.mergeDone != nil || idx.closed {
+		return
+	}
+
+	done := make(chan struct{})
+	idx.mergeDone = done
+
+	go idx.runMerges(done)
+}
+
+// runMerges merges segments until the merge policy selects no more merges
+func (idx *InvertedIndex) runMerges(done chan struct{}) {
+	defer close(done)
+
+	for {
+		idx.mu.Lock()
+
+		var merges [][]*segment
+		if !idx.closed && !idx.readOnly {
+			merges = idx.findMerges()
+		}
+
+		if len(merges) == 0 {
+			idx.mergeDone = nil
+			idx.mu.Unlock()
+			return
+		}
+
+		deleted := idx.committedDeleted.Clone()
+		idx.mu.Unlock()
+
+		for _, segments := range merges {
+			if err := idx.mergeSegments(segments, deleted); err != nil {
+				idx.mu.Lock()
+				idx.mergeErr = fmt.Errorf("merging segments: %w", err)
+				idx.mergeDone = nil
+				idx.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// findMerges returns segments to merge selected by the merge policy,
+// groups with unknown or repeated segments are ignored
+func (idx *InvertedIndex) findMerges() [][]*segment {
+	byGen := make(map[uint64]*segment, len(idx.segments))
+	for _, s := range idx.segments {
+		byGen[s.gen] = s
+	}
+
+	merges := make([][]*segment, 0)
+
+	for _, group := range idx.mergePolicy.FindMerges(idx.segmentInfos()) {
+		segments := make([]*segment, 0, len(group))
+		for _, info := range group {
+			if s, ok := byGen[info.Generation]; ok {
+				segments = append(segments, s)
+				delete(byGen, info.Generation)
+			}
+		}
+
+		// a single segment is only rewritten to reclaim deleted documents
+		if len(segments) > 1 || len(segments) == 1 && segments[0].docs.Intersects(idx.committedDeleted) {
+			merges = append(merges, segments)
+		}
+	}
+
+	return merges
+}
+
+/*
+mergeSegments writes documents of segments that are not in deleted as a new
+segment and replaces segments with it. Files are written without holding
+the lock so the index can be searched and modified meanwhile, segments are
+replaced only if none of them has been replaced by another merge. Files of
+replaced segments are removed, indexes searching them keep reading them.
+*/
+func (idx *InvertedIndex) mergeSegments(segments []*segment, deleted *roaring.Bitmap) error {
+	idx.mu.Lock()
+	gen := idx.generation
+	idx.generation++
+	dir, compress := idx.dir, idx.compressDocuments
+	idx.mu.Unlock()
+
+	merged, err := writeMergedSegment(dir, gen, segments, deleted, compress)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+
+	if !idx.replaceSegments(segments, merged) {
+		idx.mu.Unlock()
+
+		if merged != nil {
+			removeSegment(dir, merged)
+		}
+		return nil
+	}
+
+	err = idx.serializeSegmentList()
+	if err == nil {
+		// readers are opened again with the new segments
+		err = idx.closeDisk()
+	}
+
+	idx.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		removeSegment(dir, s)
+	}
+
+	return nil
+}
+
+// replaceSegments replaces segments of the index with merged, nil if all
+// their documents are deleted. It returns false if a segment is missing
+func (idx *InvertedIndex) replaceSegments(segments []*segment, merged *segment) bool {
+	replaced := make(map[*segment]bool, len(segments))
+	for _, s := range segments {
+		replaced[s] = true
+	}
+
+	rest := make([]*segment, 0, len(idx.segments))
+	for _, s := range idx.segments {
+		if !replaced[s] {
+			rest = append(rest, s)
+		}
+	}
+
+	if len(idx.segments)-len(rest) != len(segments) {
+		return false
+	}
+
+	if merged != nil {
+		rest = append(rest, merged)
+	}
+	idx.segments = rest
+
+	return true
+}
+
+// writeMergedSegment writes documents of segments that are not in deleted
+// as segment gen, nil is returned if every document is deleted
+func writeMergedSegment(dir string, gen uint64, segments []*segment, deleted *roaring.Bitmap, compress bool) (*segment, error) {
+	docs := roaring.New()
+	for _, s := range segments {
+		docs.Or(s.docs)
+	}
+	docs.AndNot(deleted)
+
+	if docs.IsEmpty() {
+		return nil, nil
+	}
+
+	keys, err := mergedKeys(dir, segments)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := openDiskIndex(dir, segments, false)
+	if err != nil {
+		return nil, err
+	}
+
+	defer files.close()
+
+	postings := func(put func(key string, postings []Posting) error) error {
+		live := make([]Posting, 0)
+		for _, key := range keys {
+			var err error
+			live, err = mergeTerm(files, key, docs, live[:0])
+			if err != nil {
+				return err
+			}
+
+			// put encodes postings before live is reused
+			if err := put(key, live); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// documents are read in DocId order, the last block read of every
+	// segment is kept so blocks are decoded once
+	type block struct {
+		num  uint32
+		docs []*Document
+	}
+	blocks := make(map[*segmentFiles]*block)
+
+	document := func(docId uint32) (*Document, error) {
+		for _, s := range files.segments {
+			if !s.docs.Contains(docId) {
+				continue
+			}
+
+			if s.documents == nil || s.unfielded {
+				return s.legacyDocument(docId)
+			}
+
+			ordinal := s.ordinal(docId)
+
+			b := blocks[s]
+			if b == nil || b.num != ordinal/documentBlockSize {
+				buf, err := s.documents.Get(uint32ToBytes(ordinal / documentBlockSize))
+				if err != nil {
+					return nil, err
+				}
+				if buf == nil {
+					return nil, ErrNotFound
+				}
+
+				decoded, err := decodeDocumentBlock(buf)
+				if err != nil {
+					return nil, err
+				}
+
+				b = &block{ordinal / documentBlockSize, decoded}
+				blocks[s] = b
+			}
+
+			i := int(ordinal % documentBlockSize)
+			if i >= len(b.docs) {
+				return nil, ErrNotFound
+			}
+			return b.docs[i], nil
+		}
+
+		return nil, ErrNotFound
+	}
+
+	return writeSegment(dir, gen, docs, postings, document, compress)
+}
+
+// mergedKeys returns the term dictionary keys of segments sorted without
+// duplicates
+func mergedKeys(dir string, segments []*segment) ([]string, error) {
+	keys := make([]string, 0)
+	for _, s := range segments {
+		segmentKeys, err := segmentKeys(dir, s)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, segmentKeys...)
+	}
+
+	sort.Strings(keys)
+
+	distinct := keys[:0]
+	for _, key := range keys {
+		if len(distinct) == 0 || key != distinct[len(distinct)-1] {
+			distinct = append(distinct, key)
+		}
+	}
+
+	return distinct, nil
+}
+
+// positionPostings iterates postings of a term in a segment with positions
+type positionPostings interface {
+	wandPostings
+	Positions() []uint32
+}
+
+// mergeTerm appends postings of key in every segment of files that are in
+// docs to live in DocId order. Posting lists are iterated together a
+// posting at a time, positions of documents not in docs are not decoded
+func mergeTerm(files *diskIndex, key string, docs *roaring.Bitmap, live []Posting) ([]Posting, error) {
+	lists := make([]positionPostings, 0, len(files.segments))
+
+	for _, s := range files.segments {
+		buf, err := s.postingList(key)
+		if err != nil {
+			return nil, err
+		}
+		if buf == nil {
+			continue
+		}
+
+		var it positionPostings
+		if s.format == postingFormatRaw {
+			postings, err := deserializePostings(buf)
+			if err != nil {
+				return nil, err
+			}
+			it = newSlicePostings(postings)
+		} else {
+			blocks, err := newPostingIterator(buf, s.format)
+			if err != nil {
+				return nil, err
+			}
+			it = blocks
+		}
+
+		if it.Next() {
+			lists = append(lists, it)
+		} else if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for len(lists) > 0 {
+		// segments hold distinct documents, the next posting is the one
+		// with the lowest DocId
+		next := 0
+		for i := range lists {
+			if lists[i].DocId() < lists[next].DocId() {
+				next = i
+			}
+		}
+
+		it := lists[next]
+		if docs.Contains(it.DocId()) {
+			live = append(live, Posting{DocId: it.DocId(), frequency: it.Freq(), Boost: 1.0, positions: it.Positions()})
+		}
+
+		if !it.Next() {
+			if err := it.Err(); err != nil {
+				return nil, err
+			}
+			lists = append(lists[:next], lists[next+1:]...)
+		}
+	}
+
+	return live, nil
+}
@@ -0,0 +1,358 @@
+package inverted
+
+import (
+	"math"
+	"sort"
+)
+
+// SegmentInfo describes a segment of an index, see Segments
+type SegmentInfo struct {
+	// Generation identifies the segment, newer segments have higher generations
+	Generation uint64
+
+	// NumDocs is the number of documents of the segment including deleted ones
+	NumDocs int
+
+	// NumDeleted is the number of documents of the segment deleted before
+	// the last MarshalIndex, they are removed when the segment is merged
+	NumDeleted int
+
+	// Size is the size of the files of the segment in bytes
+	Size int64
+}
+
+// liveSize estimates the size of the segment without deleted documents
+func (s SegmentInfo) liveSize() int64 {
+	if s.NumDocs == 0 {
+		return 0
+	}
+	return int64(float64(s.Size) * (1 - float64(s.NumDeleted)/float64(s.NumDocs)))
+}
+
+// deletedPct returns the percentage of deleted documents of the segment
+func (s SegmentInfo) deletedPct() float64 {
+	if s.NumDocs == 0 {
+		return 0
+	}
+	return 100 * float64(s.NumDeleted) / float64(s.NumDocs)
+}
+
+// MergePolicy selects segments of an index to merge in the background after
+// MarshalIndex. It is called again after selected merges are done until it
+// returns no merges
+type MergePolicy interface {
+	// FindMerges returns groups of segments that are each merged into a
+	// single segment, a segment must not be in more than one group. A group
+	// with a single segment rewrites it without its deleted documents
+	FindMerges(segments []SegmentInfo) [][]SegmentInfo
+}
+
+/*
+TieredMergePolicy merges segments of about the same size, it allows
+SegmentsPerTier segments on every tier of sizes and merges the group of at
+most MaxMergeAtOnce segments with the lowest skew when there are more.
+Skew of a group is the share of its largest segment in the merged size, so
+segments of similar sizes are merged first. Segments with more than
+DeletesPctAllowed percent of deleted documents are rewritten to reclaim the
+space of their deleted documents. Zero fields use the defaults below.
+*/
+type TieredMergePolicy struct {
+	// number of segments allowed on a tier, default 10
+	SegmentsPerTier int
+
+	// maximum number of segments merged at once, default 10
+	MaxMergeAtOnce int
+
+	// segments smaller than FloorSegmentSize bytes are treated as being
+	// that size so tiny segments are merged eagerly, default 2MB
+	FloorSegmentSize int64
+
+	// merges do not produce segments larger than MaxMergedSegmentSize
+	// bytes, default 5GB
+	MaxMergedSegmentSize int64
+
+	// percentage of deleted documents of a segment before it is rewritten,
+	// default 20
+	DeletesPctAllowed float64
+}
+
+func (p *TieredMergePolicy) segmentsPerTier() int {
+	if p.SegmentsPerTier < 2 {
+		return 10
+	}
+	return p.SegmentsPerTier
+}
+
+func (p *TieredMergePolicy) maxMergeAtOnce() int {
+	if p.MaxMergeAtOnce < 2 {
+		return 10
+	}
+	return p.MaxMergeAtOnce
+}
+
+func (p *TieredMergePolicy) floorSegmentSize() int64 {
+	if p.FloorSegmentSize <= 0 {
+		return 2 << 20
+	}
+	return p.FloorSegmentSize
+}
+
+func (p *TieredMergePolicy) maxMergedSegmentSize() int64 {
+	if p.MaxMergedSegmentSize <= 0 {
+		return 5 << 30
+	}
+	return p.MaxMergedSegmentSize
+}
+
+func (p *TieredMergePolicy) deletesPctAllowed() float64 {
+	if p.DeletesPctAllowed <= 0 {
+		return 20
+	}
+	return p.DeletesPctAllowed
+}
+
+func (p *TieredMergePolicy) floorSize(size int64) int64 {
+	if size < p.floorSegmentSize() {
+		return p.floorSegmentSize()
+	}
+	return size
+}
+
+// FindMerges implements MergePolicy
+func (p *TieredMergePolicy) FindMerges(segments []SegmentInfo) [][]SegmentInfo {
+	maxSize := p.maxMergedSegmentSize()
+
+	// segments close to the maximum size are only rewritten for deletes
+	eligible := make([]SegmentInfo, 0, len(segments))
+	for _, s := range segments {
+		if s.liveSize() < maxSize/2 {
+			eligible = append(eligible, s)
+		}
+	}
+
+	sort.SliceStable(eligible, func(i, j int) bool { return eligible[i].liveSize() > eligible[j].liveSize() })
+
+	merges := make([][]SegmentInfo, 0)
+	merged := make(map[uint64]bool)
+
+	allowed := p.allowedSegments(eligible)
+
+	for len(eligible) > allowed {
+		best, bestScore := []SegmentInfo(nil), math.Inf(1)
+
+		for start := range eligible {
+			candidate := make([]SegmentInfo, 0, p.maxMergeAtOnce())
+			size := int64(0)
+
+			for _, s := range eligible[start:] {
+				if len(candidate) == p.maxMergeAtOnce() {
+					break
+				}
+				if size+s.liveSize() > maxSize {
+					continue
+				}
+				candidate = append(candidate, s)
+				size += s.liveSize()
+			}
+
+			if len(candidate) < 2 {
+				continue
+			}
+
+			if score := p.score(candidate); score < bestScore {
+				best, bestScore = candidate, score
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		merges = append(merges, best)
+		for _, s := range best {
+			merged[s.Generation] = true
+		}
+
+		rest := eligible[:0]
+		for _, s := range eligible {
+			if !merged[s.Generation] {
+				rest = append(rest, s)
+			}
+		}
+		eligible = rest
+	}
+
+	for _, s := range segments {
+		if !merged[s.Generation] && s.deletedPct() > p.deletesPctAllowed() {
+			merges = append(merges, []SegmentInfo{s})
+		}
+	}
+
+	return merges
+}
+
+// allowedSegments returns the number of segments of a index with eligible
+// segments that are not merged, SegmentsPerTier segments are allowed on
+// tiers of sizes growing by MaxMergeAtOnce from the smallest segment
+func (p *TieredMergePolicy) allowedSegments(eligible []SegmentInfo) int {
+	if len(eligible) == 0 {
+		return 0
+	}
+
+	total := int64(0)
+	levelSize := p.floorSegmentSize()
+	for i, s := range eligible {
+		total += p.floorSize(s.liveSize())
+		if i == len(eligible)-1 {
+			levelSize = p.floorSize(s.liveSize())
+		}
+	}
+
+	allowed := 0
+	perTier := p.segmentsPerTier()
+
+	for {
+		count := total / levelSize
+		if count < int64(perTier) || levelSize >= p.maxMergedSegmentSize() {
+			allowed += int(math.Ceil(float64(total) / float64(levelSize)))
+			break
+		}
+
+		allowed += perTier
+		total -= int64(perTier) * levelSize
+		levelSize *= int64(p.maxMergeAtOnce())
+	}
+
+	if allowed < perTier {
+		allowed = perTier
+	}
+
+	return allowed
+}
+
+// score of merging segments, lower is better. Merges of similar sizes and
+// merges reclaiming deleted documents score lower
+func (p *TieredMergePolicy) score(segments []SegmentInfo) float64 {
+	var size, floored, largest, total int64
+	for _, s := range segments {
+		size += s.liveSize()
+		total += s.Size
+		floored += p.floorSize(s.liveSize())
+		if f := p.floorSize(s.liveSize()); f > largest {
+			largest = f
+		}
+	}
+
+	skew := float64(largest) / float64(floored)
+
+	// prefer merges that reclaim deleted documents
+	live := 1.0
+	if total > 0 {
+		live = float64(size) / float64(total)
+	}
+
+	return skew * math.Pow(float64(size+1), 0.05) * live * live
+}
+
+/*
+LogByteSizeMergePolicy merges segments on levels of sizes that grow by
+MergeFactor, MergeFactor adjacent segments of a level are merged into a
+segment of the next level. Segments are kept in generation order so merged
+segments hold documents added at about the same time. Zero fields use the
+defaults below.
+*/
+type LogByteSizeMergePolicy struct {
+	// number of segments of a level merged together, default 10
+	MergeFactor int
+
+	// segments smaller than MinMergeSize bytes are on the lowest level,
+	// default 1.6MB
+	MinMergeSize int64
+
+	// segments larger than MaxMergeSize bytes are not merged, default 2GB
+	MaxMergeSize int64
+}
+
+func (p *LogByteSizeMergePolicy) mergeFactor() int {
+	if p.MergeFactor < 2 {
+		return 10
+	}
+	return p.MergeFactor
+}
+
+func (p *LogByteSizeMergePolicy) minMergeSize() int64 {
+	if p.MinMergeSize <= 0 {
+		return 1638 << 10
+	}
+	return p.MinMergeSize
+}
+
+func (p *LogByteSizeMergePolicy) maxMergeSize() int64 {
+	if p.MaxMergeSize <= 0 {
+		return 2 << 30
+	}
+	return p.MaxMergeSize
+}
+
+// level of a segment of size bytes
+func (p *LogByteSizeMergePolicy) level(size int64) float64 {
+	if size < p.minMergeSize() {
+		size = p.minMergeSize()
+	}
+	return math.Log(float64(size)) / math.Log(float64(p.mergeFactor()))
+}
+
+// FindMerges implements MergePolicy
+func (p *LogByteSizeMergePolicy) FindMerges(segments []SegmentInfo) [][]SegmentInfo {
+	segments = append([]SegmentInfo(nil), segments...)
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].Generation < segments[j].Generation })
+
+	levels := make([]float64, len(segments))
+	for i, s := range segments {
+		levels[i] = p.level(s.liveSize())
+	}
+
+	factor := p.mergeFactor()
+	lowest := p.level(0)
+	merges := make([][]SegmentInfo, 0)
+
+	for start := 0; start < len(segments); {
+		// the level starts at the largest remaining segment
+		maxLevel := levels[start]
+		for _, level := range levels[start:] {
+			if level > maxLevel {
+				maxLevel = level
+			}
+		}
+
+		bottom := maxLevel - 0.75
+		if maxLevel <= lowest {
+			bottom = -1
+		}
+
+		// last segment of the level
+		upto := len(segments) - 1
+		for upto >= start && levels[upto] < bottom {
+			upto--
+		}
+
+		for end := start + factor; end <= upto+1; end += factor {
+			group := segments[end-factor : end]
+
+			tooLarge := false
+			for _, s := range group {
+				if s.liveSize() > p.maxMergeSize() {
+					tooLarge = true
+				}
+			}
+
+			if !tooLarge {
+				merges = append(merges, group)
+			}
+		}
+
+		start = upto + 1
+	}
+
+	return merges
+}
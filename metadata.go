@@ -0,0 +1,236 @@
+package inverted
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+mappedMetadata looks up the term dictionary and external ids of an index
+searched from mapped files in its mapped metadata file, they are decoded
+when they are looked up instead of being loaded when the index is opened.
+
+MarshalIndex writes the offset of every record of ":terms" and
+":externalIds" as a little endian uint32 in ":termOffsets" and
+":externalIdOffsets", and the DocId of every live document with an external
+id as ":id:" followed by the external id.
+*/
+type mappedMetadata struct {
+	reader *mappedCDB
+
+	terms             []byte
+	termOffsets       []byte
+	externalIds       []byte
+	externalIdOffsets []byte
+
+	closed bool
+}
+
+// openMappedMetadata maps the metadata file at path, nil is returned if the
+// index was written without offsets of its terms and external ids
+func openMappedMetadata(path string) (*mappedMetadata, error) {
+	reader, err := openMappedCDB(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mappedMetadata{reader: reader}
+
+	values := []struct {
+		key   string
+		value *[]byte
+	}{
+		{":terms", &m.terms},
+		{":termOffsets", &m.termOffsets},
+		{":externalIds", &m.externalIds},
+		{":externalIdOffsets", &m.externalIdOffsets},
+	}
+
+	for _, v := range values {
+		*v.value, err = reader.Get([]byte(v.key))
+		if err != nil || *v.value == nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+
+	for _, offsets := range []struct {
+		records []byte
+		offsets []byte
+	}{
+		{m.terms, m.termOffsets},
+		{m.externalIds, m.externalIdOffsets},
+	} {
+		if err := checkOffsets(offsets.records, offsets.offsets); err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// checkOffsets makes sure offsets of records are increasing and in records
+func checkOffsets(records, offsets []byte) error {
+	if len(offsets)%4 != 0 {
+		return fmt.Errorf("%w: record offsets have %d bytes", ErrCorruptIndex, len(offsets))
+	}
+
+	prev := uint32(0)
+	for i := 0; i < len(offsets); i += 4 {
+		offset := bytesToUint32le(offsets[i:])
+		if offset < prev || offset >= uint32(len(records)) {
+			return fmt.Errorf("%w: record offset %d out of range", ErrCorruptIndex, offset)
+		}
+		prev = offset
+	}
+
+	return nil
+}
+
+// record returns the bytes of record i of records
+func record(records, offsets []byte, i int) []byte {
+	start := bytesToUint32le(offsets[i*4:])
+	if (i+1)*4 < len(offsets) {
+		return records[start:bytesToUint32le(offsets[(i+1)*4:])]
+	}
+	return records[start:]
+}
+
+// numTerms returns the number of terms of the dictionary
+func (m *mappedMetadata) numTerms() int {
+	return len(m.termOffsets) / 4
+}
+
+// term decodes term i of the dictionary
+func (m *mappedMetadata) term(i int) (Term, error) {
+	if m.closed {
+		return Term{}, ErrClosed
+	}
+
+	term, _, err := decodeTerm(record(m.terms, m.termOffsets, i))
+	return term, err
+}
+
+// lookupTerm finds the term with dictionary key, terms that cannot be
+// decoded are not found
+func (m *mappedMetadata) lookupTerm(key string) (Term, bool) {
+	var err error
+	i := sort.Search(m.numTerms(), func(i int) bool {
+		term, e := m.term(i)
+		if e != nil {
+			err = e
+		}
+		return e != nil || term.Value >= key
+	})
+
+	if err != nil || i == m.numTerms() {
+		return Term{}, false
+	}
+
+	term, err := m.term(i)
+	return term, err == nil && term.Value == key
+}
+
+// expandPrefix returns terms of the dictionary whose key starts with prefix
+func (m *mappedMetadata) expandPrefix(prefix string) []Term {
+	i := sort.Search(m.numTerms(), func(i int) bool {
+		term, err := m.term(i)
+		return err != nil || term.Value >= prefix
+	})
+
+	terms := make([]Term, 0)
+	for ; i < m.numTerms(); i++ {
+		term, err := m.term(i)
+		if err != nil || !strings.HasPrefix(term.Value, prefix) {
+			break
+		}
+		terms = append(terms, term)
+	}
+
+	return terms
+}
+
+// allTerms decodes the whole term dictionary
+func (m *mappedMetadata) allTerms() ([]Term, error) {
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return deserializeTerms(m.terms)
+}
+
+// numExternalIds returns the number of external ids, one for every DocId
+func (m *mappedMetadata) numExternalIds() int {
+	return len(m.externalIdOffsets) / 4
+}
+
+// externalId returns the external id of a document, an empty string if it
+// has none
+func (m *mappedMetadata) externalId(docId uint32) (string, error) {
+	if m.closed {
+		return "", ErrClosed
+	}
+
+	if int(docId) >= m.numExternalIds() {
+		return "", nil
+	}
+
+	value, _, err := decodeString(record(m.externalIds, m.externalIdOffsets, int(docId)))
+	return value, err
+}
+
+// allExternalIds decodes external ids of all documents
+func (m *mappedMetadata) allExternalIds() ([]string, error) {
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return deserializeStrings(m.externalIds)
+}
+
+// docId returns the DocId of the live document with an external id
+func (m *mappedMetadata) docId(externalId string) (uint32, bool, error) {
+	if m.closed {
+		return 0, false, ErrClosed
+	}
+
+	buf, err := m.reader.Get([]byte(":id:" + externalId))
+	if err != nil || buf == nil {
+		return 0, false, err
+	}
+
+	if len(buf) != 4 {
+		return 0, false, fmt.Errorf("%w: DocId of %q is %d bytes", ErrCorruptIndex, externalId, len(buf))
+	}
+	return bytesToUint32le(buf), true, nil
+}
+
+// close unmaps the metadata, lookups fail with ErrClosed afterwards
+func (m *mappedMetadata) close() error {
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+	m.terms, m.termOffsets, m.externalIds, m.externalIdOffsets = nil, nil, nil, nil
+	return m.reader.Close()
+}
+
+// recordOffsets returns offsets of records of the given sizes as little
+// endian uint32s
+func recordOffsets(sizes []int) []byte {
+	buf := make([]byte, 0, len(sizes)*4)
+	offset := 0
+	for _, size := range sizes {
+		buf = append(buf, uint32ToBytes(uint32(offset))...)
+		offset += size
+	}
+	return buf
+}
+
+// uvarintSize returns the number of bytes of v encoded as uvarint
+func uvarintSize(v uint64) int {
+	var tmp [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(tmp[:], v)
+}
@@ -0,0 +1,102 @@
+package inverted
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// cdbReader reads values of a cdb file, it is implemented by cdb.CDB
+// and mappedCDB
+type cdbReader interface {
+	Get(key []byte) ([]byte, error)
+	Close() error
+}
+
+// size of the header of a cdb file, the offset and number of slots of 256
+// hash tables
+const cdbHeaderSize = 256 * 8
+
+// mappedCDB looks up values of a cdb file mapped into memory, values are
+// slices of the mapping so they are not copied. They must not be used after
+// Close and must not be modified
+type mappedCDB struct {
+	data []byte
+}
+
+func openMappedCDB(path string) (*mappedCDB, error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < cdbHeaderSize {
+		munmapFile(data)
+		return nil, fmt.Errorf("%w: %s is too small", ErrCorruptIndex, path)
+	}
+
+	return &mappedCDB{data: data}, nil
+}
+
+// cdbHash is the hash function of cdb files
+func cdbHash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, b := range key {
+		h = ((h << 5) + h) ^ uint32(b)
+	}
+	return h
+}
+
+// Get returns the value of key, nil if the key does not exist
+func (m *mappedCDB) Get(key []byte) ([]byte, error) {
+	h := cdbHash(key)
+
+	tableOffset := uint64(binary.LittleEndian.Uint32(m.data[(h&0xff)*8:]))
+	tableLen := uint64(binary.LittleEndian.Uint32(m.data[(h&0xff)*8+4:]))
+	if tableLen == 0 {
+		return nil, nil
+	}
+
+	if tableOffset+tableLen*8 > uint64(len(m.data)) {
+		return nil, fmt.Errorf("%w: cdb hash table out of range", ErrCorruptIndex)
+	}
+
+	start := uint64(h>>8) % tableLen
+	for i := uint64(0); i < tableLen; i++ {
+		slot := m.data[tableOffset+(start+i)%tableLen*8:]
+		slotHash := binary.LittleEndian.Uint32(slot)
+		offset := uint64(binary.LittleEndian.Uint32(slot[4:]))
+
+		// records start after the header, an empty slot ends the probe
+		if offset == 0 {
+			break
+		}
+
+		if slotHash != h {
+			continue
+		}
+
+		if offset+8 > uint64(len(m.data)) {
+			return nil, fmt.Errorf("%w: cdb record out of range", ErrCorruptIndex)
+		}
+		keyLen := uint64(binary.LittleEndian.Uint32(m.data[offset:]))
+		valueLen := uint64(binary.LittleEndian.Uint32(m.data[offset+4:]))
+
+		start := offset + 8
+		if start+keyLen+valueLen > uint64(len(m.data)) {
+			return nil, fmt.Errorf("%w: cdb record out of range", ErrCorruptIndex)
+		}
+
+		if string(m.data[start:start+keyLen]) == string(key) {
+			return m.data[start+keyLen : start+keyLen+valueLen : start+keyLen+valueLen], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Close unmaps the file, values returned by Get are invalid afterwards
+func (m *mappedCDB) Close() error {
+	data := m.data
+	m.data = nil
+	return munmapFile(data)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package inverted
+
+import "os"
+
+// mmapFile reads the whole file into memory on platforms where files
+// are not mapped
+func mmapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
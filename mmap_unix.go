@@ -0,0 +1,45 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package inverted
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps a file into memory read only, the mapping is shared
+// with the page cache of the operating system
+func mmapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the mapping stays valid after the file is closed
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%s is too large to be mapped", path)
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
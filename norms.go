@@ -0,0 +1,77 @@
+package inverted
+
+import "math"
+
+/*
+Norms encode field lengths in a single byte like Lucene norms. Lengths below
+numFreeNormValues are exact, longer lengths keep 4 significant bits and are
+rounded down, so the length of a document is at most maxNormError times its
+decoded length. Scorers precompute length dependent factors of their formula
+for all 256 values of a norm.
+*/
+
+// numFreeNormValues is the number of exactly encoded lengths
+var numFreeNormValues = 255 - int4(math.MaxInt32)
+
+// maxNormError is the largest ratio of a length to its decoded length
+const maxNormError = 9.0 / 8
+
+// normTable holds decoded lengths of all norm values
+var normTable = func() [256]float64 {
+	var table [256]float64
+	for i := range table {
+		table[i] = float64(decodeNorm(byte(i)))
+	}
+	return table
+}()
+
+// int4 encodes i with a 4 bit mantissa and its exponent
+func int4(i uint64) int {
+	numBits := 0
+	for v := i; v > 0; v >>= 1 {
+		numBits++
+	}
+	if numBits < 4 {
+		return int(i)
+	}
+
+	shift := uint(numBits - 4)
+	// the highest bit of the mantissa is implicit
+	encoded := int(i>>shift) & 0x07
+	return encoded | int(shift+1)<<3
+}
+
+func int4ToUint64(i int) uint64 {
+	bits := uint64(i & 0x07)
+	shift := i>>3 - 1
+	if shift == -1 {
+		return bits
+	}
+	return (bits | 0x08) << uint(shift)
+}
+
+func encodeNorm(length uint32) byte {
+	if length > math.MaxInt32 {
+		length = math.MaxInt32
+	}
+	if int(length) < numFreeNormValues {
+		return byte(length)
+	}
+	return byte(numFreeNormValues + int4(uint64(length)-uint64(numFreeNormValues)))
+}
+
+func decodeNorm(norm byte) uint32 {
+	if int(norm) < numFreeNormValues {
+		return uint32(norm)
+	}
+	return uint32(numFreeNormValues) + uint32(int4ToUint64(int(norm)-numFreeNormValues))
+}
+
+// getNorm returns the encoded length of a field for docId
+func (idx *InvertedIndex) getNorm(field string, docId uint32) byte {
+	norms := idx.norms[field]
+	if docId < uint32(len(norms)) {
+		return norms[docId]
+	}
+	return 0
+}
@@ -0,0 +1,335 @@
+package inverted
+
+import (
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// PhraseMatch returns postings of documents where the terms of a phrase,
+// given as posting lists in phrase order, occur within slop positions of
+// each other. Ordered matches require terms in phrase order, unordered
+// matches accept any order. Positions of returned postings are the first
+// positions of matches. Each match counts as 1/(1+distance) to the sloppy
+// frequency of a document, distance being the number of extra positions
+// between terms compared to the exact phrase, so closer matches score higher
+func PhraseMatch(postings [][]Posting, slop int, ordered bool) ([]Posting, []float64) {
+	result := make([]Posting, 0)
+	freqs := make([]float64, 0)
+
+	if len(postings) == 0 {
+		return result, freqs
+	}
+
+	// cursor of each posting list while intersecting by DocId
+	cursors := make([]int, len(postings))
+	positions := make([][]uint32, len(postings))
+
+	for cursors[0] < len(postings[0]) {
+		docId := postings[0][cursors[0]].DocId
+
+		// advance every list to the current document
+		matched := true
+		for i := 1; i < len(postings); i++ {
+			for cursors[i] < len(postings[i]) && postings[i][cursors[i]].DocId < docId {
+				cursors[i]++
+			}
+			if cursors[i] == len(postings[i]) {
+				return result, freqs
+			}
+			if postings[i][cursors[i]].DocId != docId {
+				matched = false
+			}
+		}
+
+		if matched {
+			for i := range postings {
+				positions[i] = postings[i][cursors[i]].positions
+			}
+
+			starts, freq := matchPositions(positions, slop, ordered)
+			if len(starts) > 0 {
+				result = append(result, Posting{DocId: docId, frequency: uint32(len(starts)), Boost: 1.0, positions: starts})
+				freqs = append(freqs, freq)
+			}
+		}
+
+		cursors[0]++
+	}
+
+	return result, freqs
+}
+
+// matchPositions matches a phrase in a document given positions of its
+// terms, it returns the first positions of matches and the sloppy frequency
+func matchPositions(positions [][]uint32, slop int, ordered bool) ([]uint32, float64) {
+	if ordered {
+		return orderedPhraseMatch(positions, slop)
+	}
+	return unorderedPhraseMatch(positions, slop)
+}
+
+// orderedPhraseMatch finds for each position of the first term the closest
+// chain of positions of the following terms, each after the previous one
+func orderedPhraseMatch(positions [][]uint32, slop int) ([]uint32, float64) {
+	starts := make([]uint32, 0)
+	freq := 0.0
+	n := len(positions)
+
+	for _, start := range positions[0] {
+		prev := start
+		distance := 0
+
+		for i := 1; i < n && distance <= slop; i++ {
+			p := positions[i]
+			k := sort.Search(len(p), func(k int) bool { return p[k] > prev })
+			if k == len(p) {
+				// later starts cannot be followed by this term either
+				return starts, freq
+			}
+
+			prev = p[k]
+			distance = int(prev-start) - i
+		}
+
+		if distance <= slop {
+			starts = append(starts, start)
+			freq += 1.0 / float64(1+distance)
+		}
+	}
+
+	return starts, freq
+}
+
+// unorderedPhraseMatch slides a window over positions of all terms and finds
+// the smallest windows containing every term of the phrase in any order
+func unorderedPhraseMatch(positions [][]uint32, slop int) ([]uint32, float64) {
+	type termPosition struct {
+		position uint32
+		term     int
+	}
+
+	// a term may be repeated in a phrase, repeated terms have the same
+	// positions. Count how many times each distinct term must occur in a window
+	need := make(map[int]int)
+	entries := make([]termPosition, 0)
+
+	for i, p := range positions {
+		term := i
+		for j := 0; j < i; j++ {
+			if equalPositions(positions[j], p) {
+				term = j
+				break
+			}
+		}
+
+		if term == i {
+			for _, pos := range p {
+				entries = append(entries, termPosition{pos, term})
+			}
+		}
+		need[term]++
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].position < entries[j].position })
+
+	starts := make([]uint32, 0)
+	freq := 0.0
+	n := len(positions)
+
+	have := make(map[int]int)
+	satisfied := 0
+	left := 0
+
+	for right := range entries {
+		t := entries[right].term
+		have[t]++
+		if have[t] == need[t] {
+			satisfied++
+		}
+
+		if satisfied < len(need) {
+			continue
+		}
+
+		// shrink the window while it still contains every term
+		for {
+			lt := entries[left].term
+			if have[lt] > need[lt] {
+				have[lt]--
+				left++
+				continue
+			}
+			break
+		}
+
+		distance := int(entries[right].position-entries[left].position) - (n - 1)
+		if distance <= slop {
+			starts = append(starts, entries[left].position)
+			freq += 1.0 / float64(1+distance)
+		}
+
+		// drop the first entry to look for the next window
+		lt := entries[left].term
+		have[lt]--
+		satisfied--
+		left++
+	}
+
+	return starts, freq
+}
+
+func equalPositions(p1, p2 []uint32) bool {
+	if len(p1) != len(p2) {
+		return false
+	}
+	for i := range p1 {
+		if p1[i] != p2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// proximityQuery adds scores of sloppy phrases to documents matching query.
+// Phrases are only matched in those documents, posting lists of their terms
+// are advanced from one document to the next so positions of other
+// documents are not decoded
+type proximityQuery struct {
+	query   Query
+	phrases []*PhraseQuery
+}
+
+func (q *proximityQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	result, err := q.query.execute(idx)
+	if err != nil || len(result) == 0 {
+		return result, err
+	}
+
+	return idx.addProximity(result, q.phrases)
+}
+
+// addProximity adds scores of phrases to documents of result sorted by
+// DocId. Every match of a phrase is a document of result when the terms
+// of the phrase are required or optional clauses of the query, so phrase
+// statistics are the same as those of a PhraseQuery
+func (idx *InvertedIndex) addProximity(result []scoreDoc, phrases []*PhraseQuery) ([]scoreDoc, error) {
+	var proximity []scoreDoc
+	for _, phrase := range phrases {
+		postings, freqs, err := idx.matchCandidates(phrase, result)
+		if err != nil {
+			return nil, err
+		}
+		scores := boostScores(idx.scorePhrase(phrase.Field, postings, freqs), phrase.Boost)
+		proximity = unionScores(proximity, scores)
+	}
+
+	return unionScores(differenceScores(result, proximity), intersectScores(result, proximity)), nil
+}
+
+// phraseSource holds posting lists of the terms of a phrase in the
+// documents of docs, all documents if docs is nil
+type phraseSource struct {
+	docs  *roaring.Bitmap
+	terms []positionPostings
+}
+
+// matchCandidates matches a phrase in candidates sorted by DocId like
+// PhraseMatch, posting lists of segments on disk are read with
+// postingIterator and only blocks of candidates are decoded
+func (idx *InvertedIndex) matchCandidates(q *PhraseQuery, candidates []scoreDoc) ([]Posting, []float64, error) {
+	sources, err := idx.phraseSources(q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make([]Posting, 0)
+	freqs := make([]float64, 0)
+	positions := make([][]uint32, len(q.Terms))
+
+	for _, doc := range candidates {
+		var terms []positionPostings
+		for _, source := range sources {
+			if source.docs == nil || source.docs.Contains(doc.DocId) {
+				terms = source.terms
+				break
+			}
+		}
+
+		matched := terms != nil
+		for i := 0; matched && i < len(terms); i++ {
+			matched = terms[i].Advance(doc.DocId) && terms[i].DocId() == doc.DocId
+			if matched {
+				positions[i] = terms[i].Positions()
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		starts, freq := matchPositions(positions, q.Slop, !q.Unordered)
+		if len(starts) > 0 {
+			result = append(result, Posting{DocId: doc.DocId, frequency: uint32(len(starts)), Boost: 1.0, positions: starts})
+			freqs = append(freqs, freq)
+		}
+	}
+
+	for _, source := range sources {
+		for _, it := range source.terms {
+			if err := it.Err(); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return result, freqs, nil
+}
+
+// phraseSources returns posting lists of the terms of a phrase in every
+// segment of a read only index, or in memory. Sources without one of the
+// terms have no posting lists
+func (idx *InvertedIndex) phraseSources(q *PhraseQuery) ([]phraseSource, error) {
+	segments, ok, err := idx.iterableSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		source := phraseSource{terms: make([]positionPostings, len(q.Terms))}
+		for i, term := range q.Terms {
+			postings, err := idx.termPostings(fieldTerm(q.Field, term), true)
+			if err != nil {
+				return nil, err
+			}
+			if len(postings) == 0 {
+				return nil, nil
+			}
+			source.terms[i] = newSlicePostings(postings)
+		}
+		return []phraseSource{source}, nil
+	}
+
+	sources := make([]phraseSource, 0, len(segments))
+	for _, s := range segments {
+		source := phraseSource{docs: s.docs, terms: make([]positionPostings, len(q.Terms))}
+		for i, term := range q.Terms {
+			buf, err := s.postingList(fieldTerm(q.Field, term))
+			if err != nil {
+				return nil, err
+			}
+			if buf == nil {
+				source.terms = nil
+				break
+			}
+
+			source.terms[i], err = newPostingIterator(buf, s.format)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,411 @@
+package inverted
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Posting lists of segments are encoded in one of the formats below, the
+// format of a file is stored under formatKey. Files written before posting
+// formats were versioned have no formatKey and use postingFormatRaw
+const (
+	// every DocId, frequency, Boost and position as a 4-byte word,
+	// see serializePostings
+	postingFormatRaw byte = 1
+
+	// delta encoded uvarints in blocks of postingBlockSize postings,
+	// see encodePostings
+	postingFormatBlock byte = 2
+
+	// postingFormatBlock with skip data of every block before the blocks
+	postingFormatSkip byte = 3
+)
+
+// postingFormat is the format written by MarshalIndex
+const postingFormat = postingFormatSkip
+
+// formatKey cannot be a term dictionary key, those have a field name before the colon
+const formatKey = ":format"
+
+// postingBlockSize is the number of postings of a block
+const postingBlockSize = 128
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+/*
+encodePostings encodes postings sorted by DocId in postingFormatSkip.
+
+The number of postings is followed by skip data and blocks of
+postingBlockSize postings, the last block may be shorter. Skip data has the
+last DocId and the size in bytes of every block, DocIds as the difference
+to the last DocId of the previous block, so blocks before a DocId can be
+skipped without being read.
+
+A block has two sections each prefixed with its length in bytes. The first
+holds the DocId and frequency of every posting, DocIds as the difference to
+the previous DocId of the list. The second holds positions of every
+posting, each as the difference to the previous position of the posting.
+Positions can be skipped without being decoded as they are not needed by
+most queries. Boost is not stored.
+*/
+func encodePostings(postings []Posting) []byte {
+	var skip, blocks, docs, positions []byte
+	prevDocId := uint32(0)
+	prevLast := uint32(0)
+
+	for start := 0; start < len(postings); start += postingBlockSize {
+		end := start + postingBlockSize
+		if end > len(postings) {
+			end = len(postings)
+		}
+
+		docs, positions = docs[:0], positions[:0]
+		for _, p := range postings[start:end] {
+			docs = appendUvarint(docs, uint64(p.DocId-prevDocId))
+			docs = appendUvarint(docs, uint64(p.frequency))
+			prevDocId = p.DocId
+
+			prevPosition := uint32(0)
+			for _, position := range p.positions {
+				positions = appendUvarint(positions, uint64(position-prevPosition))
+				prevPosition = position
+			}
+		}
+
+		size := len(blocks)
+		blocks = appendUvarint(blocks, uint64(len(docs)))
+		blocks = append(blocks, docs...)
+		blocks = appendUvarint(blocks, uint64(len(positions)))
+		blocks = append(blocks, positions...)
+
+		skip = appendUvarint(skip, uint64(prevDocId-prevLast))
+		skip = appendUvarint(skip, uint64(len(blocks)-size))
+		prevLast = prevDocId
+	}
+
+	buf := appendUvarint(nil, uint64(len(postings)))
+	buf = append(buf, skip...)
+	return append(buf, blocks...)
+}
+
+// postingIterator decodes a posting list of postingFormatBlock or
+// postingFormatSkip a block at a time, positions of a block are decoded
+// only when asked for
+type postingIterator struct {
+	// encoded blocks and the offset of the next block to read
+	blocks []byte
+	offset int
+
+	// number of postings of the list and of blocks not read yet
+	count     uint64
+	remaining uint64
+
+	// last DocId and offset of every block, nil for postingFormatBlock
+	skipDocIds []uint32
+	skipOffset []int
+
+	// number of the next block and the DocId its DocIds are relative to
+	block     int
+	prevDocId uint32
+
+	// DocIds and frequencies of the current block, i is the current posting
+	docIds []uint32
+	freqs  []uint32
+	i      int
+
+	// positions section of the current block, positions of postings
+	// before posIndex are skipped
+	positions []byte
+	posIndex  int
+
+	err error
+}
+
+func newPostingIterator(buf []byte, format byte) (*postingIterator, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: truncated posting list", ErrCorruptIndex)
+	}
+	buf = buf[n:]
+
+	it := &postingIterator{count: count, remaining: count}
+	it.i = -1
+
+	if format == postingFormatSkip {
+		numBlocks := (count + postingBlockSize - 1) / postingBlockSize
+
+		// skip data of a block takes at least two bytes
+		if numBlocks > uint64(len(buf)/2) {
+			return nil, fmt.Errorf("%w: truncated skip data", ErrCorruptIndex)
+		}
+
+		it.skipDocIds = make([]uint32, numBlocks)
+		it.skipOffset = make([]int, numBlocks)
+
+		last, offset := uint32(0), uint64(0)
+		for b := range it.skipDocIds {
+			delta, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("%w: truncated skip data", ErrCorruptIndex)
+			}
+			buf = buf[n:]
+
+			size, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("%w: truncated skip data", ErrCorruptIndex)
+			}
+			buf = buf[n:]
+
+			last += uint32(delta)
+			it.skipDocIds[b] = last
+			it.skipOffset[b] = int(offset)
+			offset += size
+		}
+
+		if offset > uint64(len(buf)) {
+			return nil, fmt.Errorf("%w: truncated posting list", ErrCorruptIndex)
+		}
+	}
+
+	it.blocks = buf
+
+	return it, nil
+}
+
+// Next moves to the next posting, it returns false at the end of the list
+// or if the list is corrupt, see Err
+func (it *postingIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.i++
+	if it.i < len(it.docIds) {
+		return true
+	}
+
+	if it.remaining == 0 {
+		return false
+	}
+
+	it.err = it.readBlock()
+	return it.err == nil
+}
+
+// Advance moves to the first posting with a DocId greater than or equal to
+// target, starting from the current posting. Blocks ending before target
+// are skipped without being decoded if the list has skip data. It returns
+// false if there is no such posting or the list is corrupt, see Err
+func (it *postingIterator) Advance(target uint32) bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.i >= 0 && it.i < len(it.docIds) && it.docIds[len(it.docIds)-1] >= target {
+		for it.docIds[it.i] < target {
+			it.i++
+		}
+		return true
+	}
+
+	if it.skipDocIds != nil {
+		rest := it.skipDocIds[it.block:]
+		b := it.block + sort.Search(len(rest), func(k int) bool { return rest[k] >= target })
+
+		if b == len(it.skipDocIds) {
+			it.remaining = 0
+			it.i = len(it.docIds)
+			return false
+		}
+
+		if b > it.block {
+			it.seekBlock(b)
+		}
+	}
+
+	for it.Next() {
+		if it.DocId() >= target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// seekBlock makes block b the next block to read
+func (it *postingIterator) seekBlock(b int) {
+	it.block = b
+	it.offset = it.skipOffset[b]
+	it.remaining = it.count - uint64(b)*postingBlockSize
+	it.prevDocId = it.skipDocIds[b-1]
+	it.docIds, it.freqs = it.docIds[:0], it.freqs[:0]
+	it.i = -1
+}
+
+// readBlock decodes DocIds and frequencies of the next block
+func (it *postingIterator) readBlock() error {
+	docs, err := it.section()
+	if err != nil {
+		return err
+	}
+	positions, err := it.section()
+	if err != nil {
+		return err
+	}
+
+	size := uint64(postingBlockSize)
+	if it.remaining < size {
+		size = it.remaining
+	}
+	it.remaining -= size
+
+	it.docIds, it.freqs = it.docIds[:0], it.freqs[:0]
+	for k := uint64(0); k < size; k++ {
+		delta, n := binary.Uvarint(docs)
+		if n <= 0 {
+			return fmt.Errorf("%w: truncated posting block", ErrCorruptIndex)
+		}
+		docs = docs[n:]
+
+		freq, n := binary.Uvarint(docs)
+		if n <= 0 {
+			return fmt.Errorf("%w: truncated posting block", ErrCorruptIndex)
+		}
+		docs = docs[n:]
+
+		it.prevDocId += uint32(delta)
+		it.docIds = append(it.docIds, it.prevDocId)
+		it.freqs = append(it.freqs, uint32(freq))
+	}
+
+	it.block++
+	it.i = 0
+	it.positions = positions
+	it.posIndex = 0
+
+	return nil
+}
+
+// section returns the next length prefixed section of the list
+func (it *postingIterator) section() ([]byte, error) {
+	buf := it.blocks[it.offset:]
+
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return nil, fmt.Errorf("%w: truncated posting block", ErrCorruptIndex)
+	}
+	it.offset += n + int(size)
+
+	return buf[n : n+int(size)], nil
+}
+
+// DocId returns the DocId of the current posting
+func (it *postingIterator) DocId() uint32 {
+	return it.docIds[it.i]
+}
+
+// Freq returns the number of occurrences of the term in the current posting
+func (it *postingIterator) Freq() uint32 {
+	return it.freqs[it.i]
+}
+
+// Positions decodes positions of the current posting, nil is returned
+// if the list is corrupt, see Err
+func (it *postingIterator) Positions() []uint32 {
+	// skip positions of postings before the current one
+	for ; it.posIndex < it.i; it.posIndex++ {
+		for k := uint32(0); k < it.freqs[it.posIndex]; k++ {
+			_, n := binary.Uvarint(it.positions)
+			if n <= 0 {
+				it.err = fmt.Errorf("%w: truncated positions", ErrCorruptIndex)
+				return nil
+			}
+			it.positions = it.positions[n:]
+		}
+	}
+
+	// every position takes at least a byte
+	if int(it.freqs[it.i]) > len(it.positions) {
+		it.err = fmt.Errorf("%w: truncated positions", ErrCorruptIndex)
+		return nil
+	}
+
+	positions := make([]uint32, it.freqs[it.i])
+	prev := uint32(0)
+	for k := range positions {
+		delta, n := binary.Uvarint(it.positions)
+		if n <= 0 {
+			it.err = fmt.Errorf("%w: truncated positions", ErrCorruptIndex)
+			return nil
+		}
+		it.positions = it.positions[n:]
+
+		prev += uint32(delta)
+		positions[k] = prev
+	}
+	it.posIndex++
+
+	return positions
+}
+
+// Err returns the error that stopped the iteration
+func (it *postingIterator) Err() error {
+	return it.err
+}
+
+// decodePostings decodes a posting list of the given format, positions are
+// decoded only if withPositions is true unless the format is postingFormatRaw
+func decodePostings(buf []byte, format byte, withPositions bool) ([]Posting, error) {
+	if format == postingFormatRaw {
+		return deserializePostings(buf)
+	}
+
+	it, err := newPostingIterator(buf, format)
+	if err != nil {
+		return nil, err
+	}
+
+	// every posting takes at least two bytes
+	size := it.remaining
+	if size > uint64(len(buf)/2) {
+		size = uint64(len(buf) / 2)
+	}
+
+	postings := make([]Posting, 0, size)
+	for it.Next() {
+		posting := Posting{DocId: it.DocId(), frequency: it.Freq(), Boost: 1.0}
+		if withPositions {
+			posting.positions = it.Positions()
+		}
+		postings = append(postings, posting)
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return postings, nil
+}
+
+// readPostingFormat returns the posting format of a postings file of a segment
+func readPostingFormat(reader cdbReader) (byte, error) {
+	buf, err := reader.Get([]byte(formatKey))
+	if err != nil {
+		return 0, err
+	}
+
+	if buf == nil {
+		return postingFormatRaw, nil
+	}
+
+	if len(buf) != 1 || buf[0] < postingFormatRaw || buf[0] > postingFormat {
+		return 0, fmt.Errorf("%w: unsupported posting format %v", ErrCorruptIndex, buf)
+	}
+
+	return buf[0], nil
+}
@@ -0,0 +1,294 @@
+package inverted
+
+import "github.com/RoaringBitmap/roaring"
+
+// Query is a node of a query tree executed against an index
+type Query interface {
+	// execute returns scores of matching documents sorted by DocId
+	execute(idx *InvertedIndex) ([]scoreDoc, error)
+}
+
+// TermQuery matches documents that contain an analyzed term in a field
+type TermQuery struct {
+	Field string
+	Term  string
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+// PhraseQuery matches documents that contain analyzed terms
+// at consecutive positions of a field, or near each other if Slop is set.
+// Documents where terms are closer to each other score higher
+type PhraseQuery struct {
+	Field string
+	Terms []string
+
+	// Slop is the number of extra positions allowed between terms,
+	// zero requires terms to be adjacent
+	Slop int
+
+	// Unordered matches terms in any order
+	Unordered bool
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+// PrefixQuery matches documents containing any term of a field that
+// starts with Prefix, matching terms are scored like a TermQuery
+type PrefixQuery struct {
+	Field  string
+	Prefix string
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+// BooleanQuery combines clauses, a document must match all Must and Filter
+// clauses and none of the MustNot clauses. Filter clauses do not contribute
+// to the score. Should clauses add to the score of documents, if there are
+// no Must or Filter clauses at least one of them must match
+type BooleanQuery struct {
+	Must    []Query
+	Should  []Query
+	MustNot []Query
+	Filter  []Query
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+// MatchAllQuery matches every document of the index with the same score
+type MatchAllQuery struct {
+	// Boost is the score of matching documents, zero means 1
+	Boost float32
+}
+
+func (q *TermQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	key := fieldTerm(q.Field, q.Term)
+	postings, err := idx.termPostings(key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return boostScores(idx.scoreTerm(key, postings), q.Boost), nil
+}
+
+func (q *PhraseQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	postings := make([][]Posting, len(q.Terms))
+
+	for i, term := range q.Terms {
+		p, err := idx.termPostings(fieldTerm(q.Field, term), true)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(p) == 0 {
+			return nil, nil
+		}
+		postings[i] = p
+	}
+
+	result, freqs := PhraseMatch(postings, q.Slop, !q.Unordered)
+
+	return boostScores(idx.scorePhrase(q.Field, result, freqs), q.Boost), nil
+}
+
+func (q *PrefixQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	return idx.executeTerms(q.Field, idx.expandPrefix(fieldTerm(q.Field, q.Prefix)), q.Boost)
+}
+
+// executeTerms returns the union of postings of expanded terms of a field,
+// each term scored like a TermQuery
+func (idx *InvertedIndex) executeTerms(field string, terms []Term, boost float32) ([]scoreDoc, error) {
+	var result []scoreDoc
+
+	for _, term := range terms {
+		postings, err := idx.termPostings(term.Value, false)
+		if err != nil {
+			return nil, err
+		}
+
+		result = unionScores(result, idx.scoreTerm(term.Value, postings))
+	}
+
+	return boostScores(result, boost), nil
+}
+
+func (q *BooleanQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	var result []scoreDoc
+
+	// Apply AND operation, leading term clauses are intersected
+	// on disk if possible
+	must := q.Must
+	if terms := leadingTerms(must); len(terms) > 1 {
+		conjunction, ok, err := idx.executeConjunction(terms)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			if len(conjunction) == 0 {
+				return conjunction, nil
+			}
+			result = conjunction
+			must = must[len(terms):]
+		}
+	}
+
+	for _, clause := range must {
+		postings, err := clause.execute(idx)
+		if err != nil {
+			return nil, err
+		}
+
+		if result == nil {
+			result = postings
+		} else {
+			result = intersectScores(result, postings)
+		}
+
+		if len(result) == 0 {
+			return result, nil
+		}
+	}
+
+	// Apply OR operation
+	var should []scoreDoc
+	for _, clause := range q.Should {
+		postings, err := clause.execute(idx)
+		if err != nil {
+			return nil, err
+		}
+		should = unionScores(should, postings)
+	}
+
+	// Apply filters without changing the score
+	for i, clause := range q.Filter {
+		postings, err := clause.execute(idx)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 && len(q.Must) == 0 {
+			result = setScores(postings, 0)
+		} else {
+			result = filterScores(result, postings)
+		}
+
+		if len(result) == 0 {
+			return result, nil
+		}
+	}
+
+	required := len(q.Must) > 0 || len(q.Filter) > 0
+
+	if !required {
+		result = should
+	} else if len(should) > 0 {
+		// should clauses only add to the score of required documents
+		result = unionScores(differenceScores(result, should), intersectScores(result, should))
+	}
+
+	if len(q.MustNot) > 0 && len(result) > 0 {
+		var excluded []scoreDoc
+		for _, clause := range q.MustNot {
+			postings, err := clause.execute(idx)
+			if err != nil {
+				return nil, err
+			}
+			excluded = unionScores(excluded, postings)
+		}
+		result = differenceScores(result, excluded)
+	}
+
+	return boostScores(result, q.Boost), nil
+}
+
+func (q *MatchAllQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	result := make([]scoreDoc, 0, idx.NumDocs)
+
+	for docId := uint32(0); docId < idx.docId; docId++ {
+		if !idx.deleted.Contains(docId) {
+			result = append(result, scoreDoc{docId, boostOrOne(q.Boost)})
+		}
+	}
+
+	return result, nil
+}
+
+// SearchOptions controls how a query is executed
+type SearchOptions struct {
+	// Filter restricts results to documents in the bitmap, such as one
+	// returned by InvertedIndex.Filter, nil means no restriction
+	Filter *roaring.Bitmap
+
+	// Fuzziness is the number of edits allowed for terms of the query,
+	// FuzzinessAuto picks it by term length. Prohibited and filter
+	// clauses and phrases always match exactly
+	Fuzziness int
+
+	// From and Size select a page of hits in ExecuteTop, Execute returns
+	// all hits if Size is zero
+	From int
+	Size int
+}
+
+// Execute runs a query and returns matching documents sorted by score
+func (idx *InvertedIndex) Execute(query Query, opts SearchOptions) ([]Posting, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if opts.Size > 0 {
+		top, err := idx.executeTop(query, opts)
+		if err != nil {
+			return nil, err
+		}
+		return top.Hits, nil
+	}
+
+	result, err := idx.match(query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sortScores(result)
+
+	return scorePostings(result), nil
+}
+
+// match runs a query and returns matching documents in DocId order
+func (idx *InvertedIndex) match(query Query, opts SearchOptions) ([]scoreDoc, error) {
+	if opts.Fuzziness != 0 {
+		query = rewriteFuzzy(query, opts.Fuzziness)
+	}
+
+	result, err := query.execute(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Filter != nil {
+		filtered := result[:0]
+		for _, doc := range result {
+			if opts.Filter.Contains(doc.DocId) {
+				filtered = append(filtered, doc)
+			}
+		}
+		result = filtered
+	}
+
+	return result, nil
+}
+
+// SearchQuery parses q with the query language of QueryParser and
+// returns matching documents sorted by score
+func (idx *InvertedIndex) SearchQuery(q string) ([]Posting, error) {
+	query, err := NewQueryParser(idx.schema).Parse(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.Execute(query, SearchOptions{})
+}
@@ -0,0 +1,603 @@
+package inverted
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Operator combines query clauses that have no explicit operator
+type Operator int
+
+const (
+	OperatorAnd Operator = iota
+	OperatorOr
+)
+
+// ParseError describes a syntax error in a query string
+type ParseError struct {
+	Query string
+	Pos   int // byte offset of the error in Query
+	Msg   string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("query parse error at position %d: %s", e.Pos, e.Msg)
+}
+
+/*
+QueryParser parses query strings like
+
+	+must -mustnot "exact phrase" "near phrase"~3 title:term^2 (a OR b)
+
+words and phrases are analyzed with the analyzer of their field, a word that
+is analyzed into multiple tokens becomes a phrase. Clauses prefixed with "+"
+are required and clauses prefixed with "-" or NOT are prohibited. Clauses
+joined with AND are required, clauses joined with OR are optional and all
+other clauses are combined with DefaultOperator. A field name followed by a
+colon applies to a word, a phrase or a parenthesized group, "^" followed by
+a number boosts the preceding clause and "~" followed by a number sets the
+slop of the preceding phrase. A word followed by "~" matches similar terms
+within the given number of edits, or a number chosen by word length if the
+number is omitted. A word ending with "*" matches all terms starting with
+the word, other words containing "*" or "?" are wildcard patterns and a
+regular expression enclosed in slashes like /[0-9]{4}-ab/ matches terms of
+the field entirely. Special characters in words can be escaped with a
+backslash.
+*/
+type QueryParser struct {
+	schema *Schema
+
+	// DefaultOperator combines clauses without an explicit operator
+	DefaultOperator Operator
+}
+
+func NewQueryParser(schema *Schema) *QueryParser {
+	return &QueryParser{schema: schema, DefaultOperator: OperatorAnd}
+}
+
+type queryTokenKind int
+
+const (
+	tokenEOF queryTokenKind = iota
+	tokenWord
+	tokenPrefix
+	tokenWildcard
+	tokenRegexp
+	tokenPhrase
+	tokenLParen
+	tokenRParen
+	tokenPlus
+	tokenMinus
+	tokenColon
+	tokenBoost
+	tokenSlop
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenPhrase:
+		return `"` + t.text + `"`
+	case tokenRegexp:
+		return "/" + t.text + "/"
+	case tokenBoost:
+		return "^" + t.text
+	case tokenSlop:
+		return "~" + t.text
+	}
+	return "'" + t.text + "'"
+}
+
+func isQuerySpecial(r rune) bool {
+	return r == '(' || r == ')' || r == '"' || r == ':' || r == '^' || r == '~' || r == '\\'
+}
+
+// lexQuery splits a query string into tokens
+func lexQuery(q string) ([]queryToken, error) {
+	tokens := make([]queryToken, 0)
+
+	// + and - are operators only at the start of a clause
+	clauseStart := true
+
+	for pos := 0; pos < len(q); {
+		r, size := utf8.DecodeRuneInString(q[pos:])
+
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+			clauseStart = true
+			continue
+
+		case r == '(' || r == ')':
+			kind := tokenLParen
+			if r == ')' {
+				kind = tokenRParen
+			}
+			tokens = append(tokens, queryToken{kind, string(r), pos})
+			pos += size
+			clauseStart = r == '('
+			continue
+
+		case r == ':':
+			tokens = append(tokens, queryToken{tokenColon, ":", pos})
+			pos += size
+			clauseStart = true
+			continue
+
+		case (r == '+' || r == '-') && clauseStart:
+			kind := tokenPlus
+			if r == '-' {
+				kind = tokenMinus
+			}
+			tokens = append(tokens, queryToken{kind, string(r), pos})
+			pos += size
+			continue
+
+		case r == '"':
+			end := strings.IndexByte(q[pos+1:], '"')
+			if end < 0 {
+				return nil, &ParseError{q, pos, "unterminated phrase"}
+			}
+			tokens = append(tokens, queryToken{tokenPhrase, q[pos+1 : pos+1+end], pos})
+			pos += end + 2
+			clauseStart = false
+			continue
+
+		case r == '/' && clauseStart:
+			end := pos + 1
+			for end < len(q) && q[end] != '/' {
+				if q[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(q) {
+				return nil, &ParseError{q, pos, "unterminated regular expression"}
+			}
+			tokens = append(tokens, queryToken{tokenRegexp, strings.ReplaceAll(q[pos+1:end], `\/`, "/"), pos})
+			pos = end + 1
+			clauseStart = false
+			continue
+
+		case r == '^':
+			start := pos + 1
+			end := start
+			for end < len(q) && (q[end] == '.' || (q[end] >= '0' && q[end] <= '9')) {
+				end++
+			}
+			if end == start {
+				return nil, &ParseError{q, pos, "missing boost value after '^'"}
+			}
+			tokens = append(tokens, queryToken{tokenBoost, q[start:end], pos})
+			pos = end
+			clauseStart = false
+			continue
+
+		case r == '~':
+			start := pos + 1
+			end := start
+			for end < len(q) && q[end] >= '0' && q[end] <= '9' {
+				end++
+			}
+			tokens = append(tokens, queryToken{tokenSlop, q[start:end], pos})
+			pos = end
+			clauseStart = false
+			continue
+		}
+
+		// read a word up to white space or a special character, pattern
+		// keeps escapes that are significant in wildcard patterns
+		var sb, pattern strings.Builder
+		start := pos
+		prefix := false
+		wildcards := 0
+		for pos < len(q) {
+			r, size = utf8.DecodeRuneInString(q[pos:])
+			prefix = false
+			if r == '\\' {
+				if pos+size >= len(q) {
+					return nil, &ParseError{q, pos, "escape character at end of query"}
+				}
+				pos += size
+				r, size = utf8.DecodeRuneInString(q[pos:])
+				if r == '*' || r == '?' || r == '\\' {
+					pattern.WriteByte('\\')
+				}
+			} else if unicode.IsSpace(r) || isQuerySpecial(r) {
+				break
+			} else if r == '*' || r == '?' {
+				prefix = r == '*'
+				wildcards++
+			}
+			sb.WriteRune(r)
+			pattern.WriteRune(r)
+			pos += size
+		}
+
+		word := sb.String()
+		kind := tokenWord
+
+		// an unescaped "*" at the end of a word makes a prefix query,
+		// other unescaped wildcards make a wildcard query
+		if prefix && wildcards == 1 && len(word) > 1 {
+			kind = tokenPrefix
+			word = word[:len(word)-1]
+		} else if wildcards > 0 && len(word) > 1 {
+			kind = tokenWildcard
+			word = pattern.String()
+		}
+
+		// operators are recognized only if they are not escaped
+		switch q[start:pos] {
+		case "AND", "&&":
+			kind = tokenAnd
+		case "OR", "||":
+			kind = tokenOr
+		case "NOT":
+			kind = tokenNot
+		}
+
+		tokens = append(tokens, queryToken{kind, word, start})
+		clauseStart = false
+	}
+
+	tokens = append(tokens, queryToken{tokenEOF, "", len(q)})
+
+	return tokens, nil
+}
+
+type clauseModifier int
+
+const (
+	modifierNone clauseModifier = iota
+	modifierRequired
+	modifierProhibited
+)
+
+type queryClause struct {
+	modifier    clauseModifier
+	conjunction queryTokenKind // tokenAnd or tokenOr joining to the previous clause
+	query       Query
+}
+
+type queryParserState struct {
+	parser *QueryParser
+	query  string
+	tokens []queryToken
+	pos    int
+}
+
+// Parse parses a query string, a *ParseError is returned for invalid queries
+func (qp *QueryParser) Parse(q string) (Query, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &queryParserState{parser: qp, query: q, tokens: tokens}
+
+	query, err := state.parseGroup(qp.schema.DefaultField(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	if query == nil {
+		return &BooleanQuery{}, nil
+	}
+
+	return query, nil
+}
+
+func (s *queryParserState) peek() queryToken {
+	return s.tokens[s.pos]
+}
+
+func (s *queryParserState) next() queryToken {
+	t := s.tokens[s.pos]
+	if t.kind != tokenEOF {
+		s.pos++
+	}
+	return t
+}
+
+func (s *queryParserState) errorf(pos int, format string, args ...interface{}) error {
+	return &ParseError{s.query, pos, fmt.Sprintf(format, args...)}
+}
+
+// parseGroup parses clauses up to the end of the query or a closing parenthesis
+func (s *queryParserState) parseGroup(field string, inParens bool) (Query, error) {
+	clauses := make([]queryClause, 0)
+	conjunction := tokenEOF
+	conjunctionPos := 0
+
+	for {
+		t := s.peek()
+
+		switch t.kind {
+		case tokenEOF:
+			if inParens {
+				return nil, s.errorf(t.pos, "missing closing parenthesis")
+			}
+		case tokenRParen:
+			if !inParens {
+				return nil, s.errorf(t.pos, "unexpected ')'")
+			}
+		case tokenAnd, tokenOr:
+			if len(clauses) == 0 || conjunction != tokenEOF {
+				return nil, s.errorf(t.pos, "unexpected operator %s", t.text)
+			}
+			s.next()
+			conjunction = t.kind
+			conjunctionPos = t.pos
+			continue
+		}
+
+		if t.kind == tokenEOF || t.kind == tokenRParen {
+			break
+		}
+
+		clause, err := s.parseClause(field)
+		if err != nil {
+			return nil, err
+		}
+
+		clause.conjunction = conjunction
+		conjunction = tokenEOF
+
+		clauses = append(clauses, clause)
+	}
+
+	if conjunction != tokenEOF {
+		return nil, s.errorf(conjunctionPos, "missing clause after operator")
+	}
+
+	return s.parser.buildBoolean(clauses), nil
+}
+
+func (s *queryParserState) parseClause(field string) (queryClause, error) {
+	clause := queryClause{}
+
+	switch s.peek().kind {
+	case tokenPlus:
+		s.next()
+		clause.modifier = modifierRequired
+	case tokenMinus, tokenNot:
+		s.next()
+		clause.modifier = modifierProhibited
+	}
+
+	query, err := s.parsePrimary(field)
+	if err != nil {
+		return clause, err
+	}
+
+	clause.query = query
+	return clause, nil
+}
+
+// parsePrimary parses a word, a phrase or a parenthesized group
+// optionally prefixed with a field name and followed by a boost
+func (s *queryParserState) parsePrimary(field string) (Query, error) {
+	t := s.next()
+
+	var query Query
+	var err error
+
+	switch t.kind {
+	case tokenWord:
+		if s.peek().kind == tokenSlop {
+			return s.parseFuzzy(field, t)
+		}
+
+		if s.peek().kind == tokenColon {
+			colon := s.next()
+			if !s.parser.schema.HasField(t.text) {
+				return nil, s.errorf(t.pos, "unknown field %q", t.text)
+			}
+
+			switch s.peek().kind {
+			case tokenWord, tokenPrefix, tokenWildcard, tokenRegexp, tokenPhrase, tokenLParen:
+			default:
+				return nil, s.errorf(colon.pos, "missing term after field %q", t.text)
+			}
+
+			return s.parsePrimary(t.text)
+		}
+		query = s.parser.analyzeTerms(field, t.text)
+
+	case tokenPrefix:
+		query = &PrefixQuery{Field: field, Prefix: normalizeTerm(s.parser.schema.Analyzer(field), t.text)}
+
+	case tokenWildcard:
+		query = &WildcardQuery{Field: field, Pattern: normalizeWildcard(s.parser.schema.Analyzer(field), t.text)}
+
+	case tokenRegexp:
+		if _, err := regexp.Compile(t.text); err != nil {
+			return nil, s.errorf(t.pos, "invalid regular expression: %v", err)
+		}
+		query = &RegexpQuery{Field: field, Pattern: t.text}
+
+	case tokenPhrase:
+		query = s.parser.analyzeTerms(field, t.text)
+
+		if s.peek().kind == tokenSlop {
+			st := s.next()
+			slop, err := strconv.Atoi(st.text)
+			if err != nil {
+				return nil, s.errorf(st.pos, "invalid phrase slop %q", st.text)
+			}
+			if pq, ok := query.(*PhraseQuery); ok {
+				pq.Slop = slop
+			}
+		}
+
+	case tokenLParen:
+		query, err = s.parseGroup(field, true)
+		if err != nil {
+			return nil, err
+		}
+		s.next()
+
+	default:
+		return nil, s.errorf(t.pos, "unexpected %s", t)
+	}
+
+	if s.peek().kind == tokenBoost {
+		b := s.next()
+		boost, err := strconv.ParseFloat(b.text, 32)
+		if err != nil || boost <= 0 {
+			return nil, s.errorf(b.pos, "invalid boost %q", b.text)
+		}
+		setBoost(query, float32(boost))
+	}
+
+	return query, nil
+}
+
+// parseFuzzy parses a word followed by "~" and an optional number of edits
+func (s *queryParserState) parseFuzzy(field string, word queryToken) (Query, error) {
+	st := s.next()
+
+	edits := FuzzinessAuto
+	if st.text != "" {
+		var err error
+		edits, err = strconv.Atoi(st.text)
+		if err != nil {
+			return nil, s.errorf(st.pos, "invalid number of edits %q", st.text)
+		}
+	}
+
+	// a word removed by the analyzer leaves query nil, its boost is still
+	// consumed below
+	var query Query
+	switch q := s.parser.analyzeTerms(field, word.text).(type) {
+	case nil:
+	case *TermQuery:
+		query = &FuzzyQuery{Field: field, Term: q.Term, MaxEdits: edits}
+	default:
+		return nil, s.errorf(word.pos, "fuzzy operator requires a single term")
+	}
+
+	if s.peek().kind == tokenBoost {
+		b := s.next()
+		boost, err := strconv.ParseFloat(b.text, 32)
+		if err != nil || boost <= 0 {
+			return nil, s.errorf(b.pos, "invalid boost %q", b.text)
+		}
+		setBoost(query, float32(boost))
+	}
+
+	return query, nil
+}
+
+// analyzeTerms analyzes text with the analyzer of field, a single token
+// becomes a TermQuery and multiple tokens a PhraseQuery
+func (qp *QueryParser) analyzeTerms(field, text string) Query {
+	terms := make([]string, 0)
+	for _, token := range qp.schema.Analyzer(field).Analyze(text) {
+		if token.value != "" {
+			terms = append(terms, token.value)
+		}
+	}
+
+	switch len(terms) {
+	case 0:
+		return nil
+	case 1:
+		return &TermQuery{Field: field, Term: terms[0]}
+	}
+
+	return &PhraseQuery{Field: field, Terms: terms}
+}
+
+// buildBoolean decides occurrence of each clause like the classic Lucene
+// query parser, clauses next to AND are required, clauses next to OR are
+// optional and others follow the default operator
+func (qp *QueryParser) buildBoolean(clauses []queryClause) Query {
+	bq := &BooleanQuery{}
+
+	for i, c := range clauses {
+		// clauses analyzed into no terms like stop words are dropped
+		if c.query == nil {
+			continue
+		}
+
+		nextConjunction := tokenEOF
+		if i+1 < len(clauses) {
+			nextConjunction = clauses[i+1].conjunction
+		}
+
+		switch {
+		case c.modifier == modifierRequired:
+			bq.Must = append(bq.Must, c.query)
+		case c.modifier == modifierProhibited:
+			bq.MustNot = append(bq.MustNot, c.query)
+		case c.conjunction == tokenAnd || nextConjunction == tokenAnd:
+			bq.Must = append(bq.Must, c.query)
+		case c.conjunction == tokenOr || nextConjunction == tokenOr:
+			bq.Should = append(bq.Should, c.query)
+		case qp.DefaultOperator == OperatorOr:
+			bq.Should = append(bq.Should, c.query)
+		default:
+			bq.Must = append(bq.Must, c.query)
+		}
+	}
+
+	// a single positive clause does not need a boolean query
+	if len(bq.MustNot) == 0 {
+		if len(bq.Must) == 1 && len(bq.Should) == 0 {
+			return bq.Must[0]
+		}
+		if len(bq.Must) == 0 && len(bq.Should) == 1 {
+			return bq.Should[0]
+		}
+		if len(bq.Must) == 0 && len(bq.Should) == 0 {
+			return nil
+		}
+	}
+
+	return bq
+}
+
+// setBoost multiplies the boost of a query
+func setBoost(query Query, boost float32) {
+	switch q := query.(type) {
+	case *TermQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *PhraseQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *BooleanQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *MatchAllQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *PrefixQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *FuzzyQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *WildcardQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	case *RegexpQuery:
+		q.Boost = boostOrOne(q.Boost) * boost
+	}
+}
+
+func boostOrOne(boost float32) float32 {
+	if boost == 0 {
+		return 1
+	}
+	return boost
+}
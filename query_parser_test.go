@@ -0,0 +1,131 @@
+package inverted
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSchema() *Schema {
+	schema := NewSchema("body", newTestAnalyzer())
+	schema.AddField("title", FieldOptions{Analyzer: newTestAnalyzer()})
+	return schema
+}
+
+func TestQueryParser(t *testing.T) {
+	qp := NewQueryParser(newTestSchema())
+
+	tests := []struct {
+		query string
+		want  Query
+	}{
+		{"Foo", &TermQuery{Field: "body", Term: "foo"}},
+		{"title:foo^2", &TermQuery{Field: "title", Term: "foo", Boost: 2}},
+		{`"New York"`, &PhraseQuery{Field: "body", Terms: []string{"new", "york"}}},
+		{"a b", &BooleanQuery{Must: []Query{&TermQuery{Field: "body", Term: "a"}, &TermQuery{Field: "body", Term: "b"}}}},
+		{"+a -b c", &BooleanQuery{
+			Must:    []Query{&TermQuery{Field: "body", Term: "a"}, &TermQuery{Field: "body", Term: "c"}},
+			MustNot: []Query{&TermQuery{Field: "body", Term: "b"}},
+		}},
+		{"title:(a OR b)^3", &BooleanQuery{
+			Should: []Query{&TermQuery{Field: "title", Term: "a"}, &TermQuery{Field: "title", Term: "b"}},
+			Boost:  3,
+		}},
+		{"a AND NOT b", &BooleanQuery{
+			Must:    []Query{&TermQuery{Field: "body", Term: "a"}},
+			MustNot: []Query{&TermQuery{Field: "body", Term: "b"}},
+		}},
+		{"e-mail", &PhraseQuery{Field: "body", Terms: []string{"e", "mail"}}},
+		{`title:"new york"~2^3`, &PhraseQuery{Field: "title", Terms: []string{"new", "york"}, Slop: 2, Boost: 3}},
+		{"kitab~1^2", &FuzzyQuery{Field: "body", Term: "kitab", MaxEdits: 1, Boost: 2}},
+		{"Ki*P?", &WildcardQuery{Field: "body", Pattern: "ki*p?"}},
+		{`a\*b*`, &PrefixQuery{Field: "body", Prefix: "a*b"}},
+		{`title:/[0-9]+\/ab/`, &RegexpQuery{Field: "title", Pattern: "[0-9]+/ab"}},
+	}
+
+	for _, test := range tests {
+		got, err := qp.Parse(test.query)
+		assert.NoError(t, err, test.query)
+		assert.Equal(t, test.want, got, test.query)
+	}
+}
+
+func TestQueryParserStopWords(t *testing.T) {
+	analyzer := NewSimpleAnalyzer(NewSimpleTokenizer())
+	analyzer.AddTokenFilter(NewLowercaseFilter())
+	analyzer.AddTokenFilter(NewStopFilter([]string{"the"}))
+	qp := NewQueryParser(NewSchema("body", analyzer))
+
+	for _, q := range []string{"the fox", "the^2 fox", "the~ fox", "the~1^2 fox", "the~^2 fox"} {
+		got, err := qp.Parse(q)
+		assert.NoError(t, err, q)
+		assert.Equal(t, &TermQuery{Field: "body", Term: "fox"}, got, q)
+	}
+}
+
+func TestQueryParserErrors(t *testing.T) {
+	qp := NewQueryParser(newTestSchema())
+
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{`"open phrase`, 0},
+		{"(a OR b", 7},
+		{"a)", 1},
+		{"a AND", 2},
+		{"OR a", 0},
+		{"author:foo", 0},
+		{"title:", 5},
+		{"a^x", 1},
+		{"+", 1},
+		{`"a b"~x`, 5},
+		{"a /[a-/", 2},
+	}
+
+	for _, test := range tests {
+		_, err := qp.Parse(test.query)
+		var parseErr *ParseError
+		if assert.True(t, errors.As(err, &parseErr), test.query) {
+			assert.Equal(t, test.pos, parseErr.Pos, test.query)
+		}
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	idx, err := Create(t.TempDir(), Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+
+	docs := []*Document{
+		NewDocument().AddField("title", "New York").AddField("body", "a city that never sleeps"),
+		NewDocument().AddField("title", "York").AddField("body", "a new city in england"),
+		NewDocument().AddField("title", "Paris").AddField("body", "a city of light"),
+	}
+	for _, doc := range docs {
+		_, err = idx.AddDocument(doc, nil)
+		assert.NoError(t, err)
+	}
+	idx.UpdateAvgFieldLen()
+
+	docIds := func(q string) []uint32 {
+		postings, err := idx.SearchQuery(q)
+		assert.NoError(t, err, q)
+		ids := make([]uint32, 0)
+		for _, p := range postings {
+			ids = append(ids, p.DocId)
+		}
+		return ids
+	}
+
+	assert.ElementsMatch(t, []uint32{0}, docIds(`title:"new york"`))
+	assert.ElementsMatch(t, []uint32{0, 1}, docIds("title:york"))
+	assert.ElementsMatch(t, []uint32{0, 2}, docIds("city -england"))
+	assert.ElementsMatch(t, []uint32{1, 2}, docIds("england OR light"))
+	assert.ElementsMatch(t, []uint32{0, 1, 2}, docIds("+city OR title:paris"))
+	assert.Equal(t, uint32(2), docIds("+city OR title:paris^5")[0])
+	assert.Empty(t, docIds("-city"))
+
+	_, err = idx.SearchQuery("(city")
+	assert.Error(t, err)
+}
@@ -0,0 +1,521 @@
+package inverted
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIndex(t *testing.T, bodies ...string) *InvertedIndex {
+	idx, err := Create(t.TempDir(), Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+
+	for i, body := range bodies {
+		category := "even"
+		if i%2 == 1 {
+			category = "odd"
+		}
+		_, err = idx.AddDocument(NewDocument().AddField("body", body), []string{category})
+		assert.NoError(t, err)
+	}
+
+	idx.UpdateAvgFieldLen()
+	idx.BuildCategoryBitmap()
+
+	return idx
+}
+
+// search runs Search and asserts it succeeds
+func search(t *testing.T, idx *InvertedIndex, q string) []Posting {
+	postings, err := idx.Search(q)
+	assert.NoError(t, err)
+	return postings
+}
+
+func postingIds(postings []Posting) []uint32 {
+	ids := make([]uint32, 0, len(postings))
+	for _, p := range postings {
+		ids = append(ids, p.DocId)
+	}
+	return ids
+}
+
+func TestExecute(t *testing.T) {
+	idx := newTestIndex(t,
+		"the quick brown fox",
+		"the lazy dog",
+		"quick thinking brown bear",
+		"a brown fox jumps",
+	)
+
+	term := func(value string) Query {
+		return &TermQuery{Field: "body", Term: value}
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []uint32
+	}{
+		{"term", term("brown"), []uint32{0, 2, 3}},
+		{"phrase", &PhraseQuery{Field: "body", Terms: []string{"brown", "fox"}}, []uint32{0, 3}},
+		{"sloppy phrase", &PhraseQuery{Field: "body", Terms: []string{"quick", "brown"}, Slop: 1}, []uint32{0, 2}},
+		{"match all", &MatchAllQuery{}, []uint32{0, 1, 2, 3}},
+		{"must not", &BooleanQuery{Must: []Query{&MatchAllQuery{}}, MustNot: []Query{term("brown")}}, []uint32{1}},
+		{"filter", &BooleanQuery{Filter: []Query{term("quick")}, Should: []Query{term("fox")}}, []uint32{0, 2}},
+		{"should", &BooleanQuery{Should: []Query{term("dog"), term("bear")}}, []uint32{1, 2}},
+	}
+
+	for _, test := range tests {
+		result, err := idx.Execute(test.query, SearchOptions{})
+		assert.NoError(t, err, test.name)
+		assert.ElementsMatch(t, test.want, postingIds(result), test.name)
+	}
+
+	// filter clauses do not change the score
+	result, err := idx.Execute(&BooleanQuery{Filter: []Query{term("quick")}, Should: []Query{term("fox")}}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), result[0].DocId)
+	assert.Equal(t, float32(0), result[1].Boost)
+
+	result, err = idx.Execute(term("brown"), SearchOptions{Filter: idx.Filter("odd")})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{3}, postingIds(result))
+}
+
+func TestPhraseSlop(t *testing.T) {
+	idx := newTestIndex(t,
+		"new york city",
+		"york new city",
+		"new big york city",
+		"new old big york and city",
+		"york city new",
+	)
+
+	tests := []struct {
+		query *PhraseQuery
+		want  []uint32
+	}{
+		{&PhraseQuery{Terms: []string{"new", "york", "city"}}, []uint32{0}},
+		{&PhraseQuery{Terms: []string{"new", "york", "city"}, Slop: 1}, []uint32{0, 2}},
+		{&PhraseQuery{Terms: []string{"new", "york", "city"}, Slop: 3}, []uint32{0, 2, 3}},
+		{&PhraseQuery{Terms: []string{"new", "york", "city"}, Unordered: true}, []uint32{0, 1, 4}},
+		{&PhraseQuery{Terms: []string{"city", "new"}, Unordered: true}, []uint32{1, 4}},
+		{&PhraseQuery{Terms: []string{"new", "new"}, Unordered: true, Slop: 5}, []uint32{}},
+	}
+
+	for _, test := range tests {
+		test.query.Field = "body"
+		result, err := idx.Execute(test.query, SearchOptions{})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, test.want, postingIds(result), "%+v", test.query)
+	}
+
+	// closer matches rank higher
+	result, err := idx.SearchQuery(`"new york city"~3`)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{0, 2, 3}, postingIds(result))
+}
+
+func TestPrefixAndSuggest(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+
+	for _, body := range []string{"kitap okumak", "kitabı aldım", "kitap evi", "kitaplık", "kalem"} {
+		_, err = idx.AddDocument(NewDocument().AddField("body", body), nil)
+		assert.NoError(t, err)
+	}
+	idx.UpdateAvgFieldLen()
+
+	want := []FacetCount{{"kitap", 2}, {"kitabı", 1}, {"kitaplık", 1}}
+	assert.Equal(t, want, idx.Suggest("Kita", 5))
+	assert.Equal(t, want[:1], idx.Suggest("kita", 1))
+	assert.Equal(t, want, idx.Suggest("kita", 0))
+	assert.Equal(t, want, idx.Suggest("kita", -1))
+	assert.Empty(t, idx.Suggest("x", 5))
+
+	result, err := idx.SearchQuery("kita*")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint32{0, 1, 2, 3}, postingIds(result))
+
+	// new terms are visible to suggestions after they are added
+	_, err = idx.AddDocument(NewDocument().AddField("body", "kitabı"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []FacetCount{{"kitabı", 2}, {"kitap", 2}}, idx.Suggest("kita", 2))
+
+	assert.NoError(t, idx.MarshalIndex())
+	loaded, err := Open(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	assert.Equal(t, []FacetCount{{"kitabı", 2}, {"kitap", 2}}, loaded.Suggest("kita", 2))
+
+	result, err = loaded.Execute(&PrefixQuery{Field: "body", Prefix: "kitap"}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint32{0, 2, 3}, postingIds(result))
+}
+
+func TestFuzzyQuery(t *testing.T) {
+	idx := newTestIndex(t, "kitap okumak", "kitab", "kitaplık", "ktiap", "kalem", "kit")
+
+	fuzzy := func(term string, edits, prefix int) []uint32 {
+		result, err := idx.Execute(&FuzzyQuery{Field: "body", Term: term, MaxEdits: edits, PrefixLength: prefix}, SearchOptions{})
+		assert.NoError(t, err)
+		return postingIds(result)
+	}
+
+	assert.ElementsMatch(t, []uint32{0, 1, 3}, fuzzy("kitap", 1, 0))
+	assert.ElementsMatch(t, []uint32{0, 1}, fuzzy("kitap", 1, 2))
+	assert.ElementsMatch(t, []uint32{0, 1, 2, 3, 5}, fuzzy("kitap", 3, 0))
+	assert.Equal(t, []uint32{1}, fuzzy("kitab", 0, 0))
+
+	// exact matches score above misspellings
+	result, err := idx.Execute(&FuzzyQuery{Field: "body", Term: "kitab", MaxEdits: 1}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), result[0].DocId)
+
+	expanded := idx.expandFuzzy("body", "kitap", 2, 0)
+	assert.Len(t, expanded, 4)
+	for _, match := range expanded {
+		assert.Equal(t, levenshteinDistance(match.term.Value[len("body:"):], "kitap"), match.distance)
+	}
+
+	result, err = idx.SearchQuery("kitab~ kalme~1")
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+	result, err = idx.SearchQuery("kitab~ OR kalme~1")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint32{0, 1, 4}, postingIds(result))
+
+	result, err = idx.Execute(&TermQuery{Field: "body", Term: "ktiab"}, SearchOptions{Fuzziness: FuzzinessAuto})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint32{1, 3}, postingIds(result))
+}
+
+// levenshteinDistance is a plain dynamic programming reference for the
+// automaton in expandFuzzy
+func levenshteinDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j] + 1
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if d[i-1][j-1]+cost < d[i][j] {
+				d[i][j] = d[i-1][j-1] + cost
+			}
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+func TestWildcardAndRegexp(t *testing.T) {
+	schema := newTestSchema()
+	assert.NoError(t, schema.AddField("code", FieldOptions{Analyzer: NewSimpleAnalyzer(NewKeywordTokenizer())}))
+
+	idx, err := Create(t.TempDir(), Options{Schema: schema})
+	assert.NoError(t, err)
+
+	for _, doc := range [][2]string{{"kitap", "2019-ab"}, {"kitab", "2020-ab"}, {"kalıp", "2020-cd"}, {"kap", "k*p"}} {
+		_, err = idx.AddDocument(NewDocument().AddField("body", doc[0]).AddField("code", doc[1]), nil)
+		assert.NoError(t, err)
+	}
+	idx.UpdateAvgFieldLen()
+
+	execute := func(q Query) []uint32 {
+		result, err := idx.Execute(q, SearchOptions{})
+		assert.NoError(t, err)
+		return postingIds(sortedById(result))
+	}
+
+	assert.Equal(t, []uint32{0, 2, 3}, execute(&WildcardQuery{Field: "body", Pattern: "k*p"}))
+	assert.Equal(t, []uint32{0, 1}, execute(&WildcardQuery{Field: "body", Pattern: "kita?"}))
+	assert.Equal(t, []uint32{3}, execute(&WildcardQuery{Field: "code", Pattern: `k\*p`}))
+	assert.Equal(t, []uint32{0, 1}, execute(&RegexpQuery{Field: "code", Pattern: "[0-9]{4}-ab"}))
+	assert.Equal(t, []uint32{1, 2}, execute(&RegexpQuery{Field: "code", Pattern: "2020.*"}))
+
+	result, err := idx.Execute(&RegexpQuery{Field: "body", Pattern: "k.*", ConstantScore: true, Boost: 2}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, result, 4)
+	for _, p := range result {
+		assert.Equal(t, float32(2), p.Boost)
+	}
+
+	_, err = idx.Execute(&WildcardQuery{Field: "body", Pattern: "*", MaxExpansions: 3}, SearchOptions{})
+	assert.True(t, errors.Is(err, ErrTooManyTerms))
+	_, err = idx.Execute(&RegexpQuery{Field: "body", Pattern: "[a-"}, SearchOptions{})
+	assert.Error(t, err)
+
+	result, err = idx.SearchQuery(`KI?A* OR code:/20(19|21)-ab/ OR code:k\*p`)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1, 3}, postingIds(sortedById(result)))
+
+	_, err = idx.SearchQuery("/unterminated")
+	assert.Error(t, err)
+}
+
+func sortedById(postings []Posting) []Posting {
+	sort.Slice(postings, func(i, j int) bool { return postings[i].DocId < postings[j].DocId })
+	return postings
+}
+
+func TestSpellCheck(t *testing.T) {
+	idx := newTestIndex(t, "kitap okumak", "kitap evi", "kitab", "okul", "okul kitap")
+
+	// only tokens missing from the index are corrected in the suggestion
+	result := idx.SpellCheck("Kitab okuul")
+	assert.Equal(t, "kitab okul", result.Suggestion)
+	assert.Equal(t, []TokenSuggestion{
+		{Field: "body", Token: "kitab", DocFreq: 1, Candidates: []FacetCount{{"kitap", 3}}},
+		{Field: "body", Token: "okuul", DocFreq: 0, Candidates: []FacetCount{{"okul", 2}}},
+	}, result.Tokens)
+
+	assert.Equal(t, "kitap okul", idx.SpellCheck("kitap okl").Suggestion)
+	assert.Equal(t, "", idx.SpellCheck("kitap okul").Suggestion)
+	assert.Equal(t, "", idx.SpellCheck("xyzzy").Suggestion)
+
+	// deleted documents are not counted before the index is committed
+	assert.NoError(t, idx.Delete(2))
+	assert.NoError(t, idx.Delete(4))
+	result = idx.SpellCheck("kitab")
+	assert.Equal(t, "kitap", result.Suggestion)
+	assert.Equal(t, []FacetCount{{"kitap", 2}}, result.Tokens[0].Candidates)
+}
+
+func TestExecuteTop(t *testing.T) {
+	bodies := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		bodies = append(bodies, strings.Repeat("word ", i%5+1)+"filler text")
+	}
+	idx := newTestIndex(t, bodies...)
+
+	query := &TermQuery{Field: "body", Term: "word"}
+	all, err := idx.Execute(query, SearchOptions{})
+	assert.NoError(t, err)
+
+	for _, page := range []struct{ from, size int }{{0, 10}, {5, 7}, {25, 10}, {40, 10}} {
+		top, err := idx.ExecuteTop(query, SearchOptions{From: page.from, Size: page.size})
+		assert.NoError(t, err)
+		assert.Equal(t, 30, top.TotalHits)
+
+		end := page.from + page.size
+		if end > len(all) {
+			end = len(all)
+		}
+		if page.from > len(all) {
+			assert.Empty(t, top.Hits)
+		} else {
+			assert.Equal(t, postingIds(all[page.from:end]), postingIds(top.Hits))
+		}
+	}
+
+	top, err := idx.SearchPage("word", 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, top.Hits, DefaultPageSize)
+
+	odd, err := idx.ExecuteTop(query, SearchOptions{Filter: idx.Filter("odd"), Size: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, 15, odd.TotalHits)
+}
+
+func TestWandMatchesExhaustiveTopK(t *testing.T) {
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon"}
+	bodies := make([]string, 0)
+	for i := 0; i < 200; i++ {
+		body := make([]string, 0)
+		for j, word := range words {
+			if (i*7+j*3)%(j+2) == 0 {
+				body = append(body, strings.Repeat(word+" ", (i+j)%3+1))
+			}
+		}
+		bodies = append(bodies, strings.Join(body, " ")+" filler")
+	}
+
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	for i, body := range bodies {
+		_, err = idx.AddDocument(NewDocument().AddField("body", body), nil)
+		assert.NoError(t, err)
+
+		// postings are iterated on disk a segment at a time
+		if i == 99 {
+			assert.NoError(t, idx.MarshalIndex())
+		}
+	}
+	assert.NoError(t, idx.Delete(3))
+	idx.UpdateAvgFieldLen()
+
+	query := &BooleanQuery{Should: []Query{
+		&TermQuery{Field: "body", Term: "alpha"},
+		&TermQuery{Field: "body", Term: "gamma", Boost: 2},
+		&TermQuery{Field: "body", Term: "epsilon"},
+	}, Boost: 1.5}
+
+	check := func(idx *InvertedIndex) {
+		for _, size := range []int{1, 5, 20, 500} {
+			all, err := idx.match(query, SearchOptions{})
+			assert.NoError(t, err)
+			want := scorePostings(topK(all, size))
+
+			top, err := idx.ExecuteTop(query, SearchOptions{Size: size})
+			assert.NoError(t, err)
+			assert.True(t, top.TotalHits >= len(top.Hits) && top.TotalHits <= len(all))
+			if !top.TotalHitsLowerBound || size > len(all) {
+				assert.Equal(t, len(all), top.TotalHits)
+				assert.False(t, top.TotalHitsLowerBound)
+			}
+			assert.Equal(t, postingIds(want), postingIds(top.Hits))
+			for i := range want {
+				assert.Equal(t, want[i].Boost, top.Hits[i].Boost)
+			}
+		}
+	}
+
+	check(idx)
+
+	assert.NoError(t, idx.MarshalIndex())
+	readOnly, err := Open(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	for _, term := range readOnly.termDictionary() {
+		assert.True(t, term.MaxScore > 0, term.Value)
+	}
+	check(readOnly)
+}
+
+func TestConjunctionOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		body := "common"
+		if i%3 == 0 {
+			body += " third third"
+		}
+		if i%250 == 7 {
+			body += " rare"
+		}
+		_, err = idx.AddDocument(NewDocument().AddField("body", body), nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.Delete(10))
+	assert.NoError(t, idx.MarshalIndex())
+
+	onDisk, err := Open(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	inMemory, err := Open(dir, Options{Schema: newTestSchema(), LoadIntoMemory: true})
+	assert.NoError(t, err)
+
+	queries := []*BooleanQuery{
+		{Must: []Query{&TermQuery{Field: "body", Term: "common"}, &TermQuery{Field: "body", Term: "rare", Boost: 3}}},
+		{Must: []Query{&TermQuery{Field: "body", Term: "third"}, &TermQuery{Field: "body", Term: "common"}}, Boost: 2},
+		{Must: []Query{
+			&TermQuery{Field: "body", Term: "rare"},
+			&TermQuery{Field: "body", Term: "third"},
+			&PhraseQuery{Field: "body", Terms: []string{"common", "third"}},
+		}},
+		{Must: []Query{&TermQuery{Field: "body", Term: "common"}, &TermQuery{Field: "body", Term: "missing"}}},
+	}
+
+	for _, query := range queries {
+		terms := leadingTerms(query.Must)
+		_, ok, err := onDisk.executeConjunction(terms)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		want, err := inMemory.Execute(query, SearchOptions{})
+		assert.NoError(t, err)
+		got, err := onDisk.Execute(query, SearchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	postings, err := onDisk.Execute(queries[0], SearchOptions{})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []uint32{7, 257, 507, 757}, postingIds(postings))
+}
+
+func TestQueriesDoNotModifyPostings(t *testing.T) {
+	idx := newTestIndex(t, "the quick brown fox", "the lazy dog", "quick thinking brown bear", "a brown fox jumps")
+
+	snapshot := make(map[string][]Posting)
+	for key, postings := range idx.index {
+		snapshot[key] = append([]Posting(nil), postings...)
+	}
+
+	queries := []string{"quick OR brown", "+brown fox^2", `"brown fox"~2`, "bro*", "qiuck~", "b?own", "brown -lazy"}
+	var first [][]Posting
+	for round := 0; round < 2; round++ {
+		for i, q := range queries {
+			result, err := idx.SearchQuery(q)
+			assert.NoError(t, err)
+			if round == 0 {
+				first = append(first, result)
+			} else {
+				assert.Equal(t, first[i], result, q)
+			}
+		}
+	}
+	assert.Equal(t, snapshot, idx.index)
+
+	a := []Posting{{DocId: 1, Boost: 1}, {DocId: 2, Boost: 1}}
+	b := []Posting{{DocId: 2, Boost: 2}, {DocId: 3, Boost: 2}}
+	assert.Equal(t, []Posting{{DocId: 1, Boost: 1}, {DocId: 2, Boost: 3}, {DocId: 3, Boost: 2}}, Union(a, b))
+	assert.Equal(t, []Posting{{DocId: 2, Boost: 3}}, Intersection(a, b))
+	assert.Equal(t, float32(2), b[0].Boost)
+}
+
+func TestSearchProximity(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	for i, body := range []string{"new york city", "york is new", "new and old york", "old city", "new delhi", "city of new york"} {
+		_, err = idx.AddDocument(NewDocument().AddField("body", body), nil)
+		assert.NoError(t, err)
+		if i == 2 {
+			assert.NoError(t, idx.MarshalIndex())
+		}
+	}
+	assert.NoError(t, idx.Delete(5))
+	assert.NoError(t, idx.MarshalIndex())
+
+	onDisk, err := Open(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+	inMemory, err := Open(dir, Options{Schema: newTestSchema(), LoadIntoMemory: true})
+	assert.NoError(t, err)
+
+	// phrases score like optional PhraseQuery clauses of all documents
+	phrase := &PhraseQuery{Field: "body", Terms: []string{"new", "york"}, Slop: searchPhraseSlop}
+	terms := []Query{&TermQuery{Field: "body", Term: "new"}, &TermQuery{Field: "body", Term: "york"}}
+	for _, loaded := range []*InvertedIndex{onDisk, inMemory} {
+		want, err := loaded.Execute(&BooleanQuery{Must: terms, Should: []Query{phrase}}, SearchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, want, search(t, loaded, "new york"))
+		assert.Equal(t, uint32(0), want[0].DocId)
+
+		want, err = loaded.Execute(&BooleanQuery{Should: append(terms, phrase)}, SearchOptions{})
+		assert.NoError(t, err)
+		got, err := loaded.SearchOr("new york")
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+		assert.Len(t, got, 4)
+	}
+}
@@ -0,0 +1,129 @@
+package inverted
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DefaultField is the field used for plain text documents and query terms
+// that do not name a field
+const DefaultField = "text"
+
+// FieldOptions describes how values of a field are indexed
+type FieldOptions struct {
+	// Analyzer to use for text analysis and tokenization of the field
+	Analyzer Analyzer
+
+	// Stored keeps the original field values in the document store
+	// so they can be returned with InvertedIndex.Document
+	Stored bool
+
+	// Similarity scores terms of the field, if nil the similarity
+	// of the index is used
+	Similarity Similarity
+}
+
+// Schema assigns an Analyzer to every field of the documents in an index
+type Schema struct {
+	defaultField string
+	idField      string
+	fields       map[string]FieldOptions
+}
+
+// NewSchema creates a schema with a single default field analyzed by analyzer
+func NewSchema(defaultField string, analyzer Analyzer) *Schema {
+	s := &Schema{}
+	s.defaultField = defaultField
+	s.fields = make(map[string]FieldOptions)
+	s.fields[defaultField] = FieldOptions{Analyzer: analyzer}
+	return s
+}
+
+// AddField adds a new field to the schema or replaces options of an existing one,
+// field names cannot be empty or contain spaces or colons
+func (s *Schema) AddField(name string, opts FieldOptions) error {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool { return r == ':' || unicode.IsSpace(r) }) >= 0 {
+		return fmt.Errorf("invalid field name %q", name)
+	}
+
+	if opts.Analyzer == nil {
+		return fmt.Errorf("field %q has no analyzer", name)
+	}
+
+	s.fields[name] = opts
+	return nil
+}
+
+// SetIDField sets the field holding external ids of documents that
+// InvertedIndex.Update uses to find the documents it replaces, the field
+// should be analyzed into a single token such as with KeywordTokenizer
+func (s *Schema) SetIDField(name string) error {
+	if !s.HasField(name) {
+		return fmt.Errorf("field %q is not in the schema", name)
+	}
+
+	s.idField = name
+	return nil
+}
+
+// IDField returns the field holding external ids of documents
+func (s *Schema) IDField() string {
+	return s.idField
+}
+
+// DefaultField returns the field searched by query terms that do not name a field
+func (s *Schema) DefaultField() string {
+	return s.defaultField
+}
+
+// HasField reports whether name is a field of the schema
+func (s *Schema) HasField(name string) bool {
+	_, ok := s.fields[name]
+	return ok
+}
+
+// Fields returns the sorted names of all fields
+func (s *Schema) Fields() []string {
+	names := make([]string, 0, len(s.fields))
+	for name := range s.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsStored reports whether original values of a field are stored
+func (s *Schema) IsStored(field string) bool {
+	return s.fields[field].Stored
+}
+
+// Analyzer returns the analyzer of a field, fields not in the
+// schema are analyzed with the analyzer of the default field
+func (s *Schema) Analyzer(field string) Analyzer {
+	if opts, ok := s.fields[field]; ok {
+		return opts.Analyzer
+	}
+	return s.fields[s.defaultField].Analyzer
+}
+
+// Similarity returns the similarity set in the options of field, or nil
+func (s *Schema) Similarity(field string) Similarity {
+	return s.fields[field].Similarity
+}
+
+// fieldTerm builds the key of a term in the term dictionary,
+// terms of every field are prefixed with the field name and a colon
+func fieldTerm(field, term string) string {
+	return field + ":" + term
+}
+
+// splitFieldTerm splits a term dictionary key into field name and term
+func splitFieldTerm(key string) (string, string) {
+	i := strings.IndexByte(key, ':')
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
@@ -0,0 +1,152 @@
+package inverted
+
+import "sort"
+
+/*
+Queries accumulate scores of matching documents in slices of scoreDoc sorted
+by DocId that belong to a single execution. Postings of the index are only
+read while scoring, so concurrent queries never write to shared data and
+results do not depend on the order queries run in.
+*/
+
+// scoreDoc is the score of a document matching a query
+type scoreDoc struct {
+	DocId uint32
+	Score float32
+}
+
+// newScores returns scores of documents of postings, all set to score
+func newScores(postings []Posting, score float32) []scoreDoc {
+	scores := make([]scoreDoc, len(postings))
+	for i, p := range postings {
+		scores[i] = scoreDoc{p.DocId, score}
+	}
+	return scores
+}
+
+// unionScores returns documents in a or b, scores of documents in both are summed
+func unionScores(a, b []scoreDoc) []scoreDoc {
+	result := make([]scoreDoc, 0, len(a)+len(b))
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId < b[j].DocId {
+			result = append(result, a[i])
+			i++
+		} else if b[j].DocId < a[i].DocId {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, scoreDoc{a[i].DocId, a[i].Score + b[j].Score})
+			i++
+			j++
+		}
+	}
+
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// intersectScores returns documents in both a and b with summed scores
+func intersectScores(a, b []scoreDoc) []scoreDoc {
+	result := make([]scoreDoc, 0)
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId < b[j].DocId {
+			i++
+		} else if b[j].DocId < a[i].DocId {
+			j++
+		} else {
+			result = append(result, scoreDoc{a[i].DocId, a[i].Score + b[j].Score})
+			i++
+			j++
+		}
+	}
+
+	return result
+}
+
+// filterScores returns documents of a that are in b keeping scores of a
+func filterScores(a, b []scoreDoc) []scoreDoc {
+	result := make([]scoreDoc, 0)
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId < b[j].DocId {
+			i++
+		} else if b[j].DocId < a[i].DocId {
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+
+	return result
+}
+
+// differenceScores returns documents of a that are not in b
+func differenceScores(a, b []scoreDoc) []scoreDoc {
+	result := make([]scoreDoc, 0, len(a))
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId < b[j].DocId {
+			result = append(result, a[i])
+			i++
+		} else if b[j].DocId < a[i].DocId {
+			j++
+		} else {
+			i++
+			j++
+		}
+	}
+
+	return append(result, a[i:]...)
+}
+
+// boostScores multiplies scores by boost, zero means 1
+func boostScores(scores []scoreDoc, boost float32) []scoreDoc {
+	if boost == 0 || boost == 1 {
+		return scores
+	}
+
+	for i := range scores {
+		scores[i].Score *= boost
+	}
+	return scores
+}
+
+// setScores sets all scores to score
+func setScores(scores []scoreDoc, score float32) []scoreDoc {
+	for i := range scores {
+		scores[i].Score = score
+	}
+	return scores
+}
+
+// worse reports whether a ranks below b, equal scores rank the lower
+// DocId first so results are deterministic
+func worse(a, b scoreDoc) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.DocId > b.DocId
+}
+
+// sortScores sorts documents from the best to the worst score
+func sortScores(scores []scoreDoc) {
+	sort.Slice(scores, func(i, j int) bool { return worse(scores[j], scores[i]) })
+}
+
+// scorePostings converts scores to postings returned by searches, the score
+// of a document is in the Boost of its posting
+func scorePostings(scores []scoreDoc) []Posting {
+	postings := make([]Posting, len(scores))
+	for i, s := range scores {
+		postings[i] = Posting{DocId: s.DocId, Boost: s.Score}
+	}
+	return postings
+}
@@ -1,281 +1,177 @@
 package inverted
 
-import "sort"
-
-func (idx *InvertedIndex) Search_Cdb(q string) []Posting {
-	tokens := idx.analyzer.Analyze(q)
-
-	var result []Posting
-	var resultPhrase []Posting
+import (
+	"strings"
+)
+
+// Hit is a document matching a search
+type Hit struct {
+	DocId      uint32
+	ExternalId string
+	Score      float32
+}
 
-	postings := make(map[int][]Posting)
+// Hits converts postings returned by a search to hits carrying
+// the external id of each document
+func (idx *InvertedIndex) Hits(postings []Posting) []Hit {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
 
-	for i, token := range tokens {
-		postings[i] = ReadPosting_Cdb(token.value)
-		idx.scorePosting(postings[i])
-	}
-
-	// Apply AND operation
-	for i := range tokens {
-		if i == 0 {
-			result = postings[0]
-		} else {
-			result = Intersection(result, postings[i])
-		}
-	}
+	hits := make([]Hit, len(postings))
 
-	// Apply AND operation
-	for i := range tokens {
-		if i == 0 {
-			resultPhrase = postings[0]
-		} else {
-			resultPhrase = PhraseQuery_FullMatch(resultPhrase, postings[i])
-		}
+	for i, posting := range postings {
+		hits[i].DocId = posting.DocId
+		hits[i].Score = posting.Boost
+		// external ids of a closed index searched from mapped files are
+		// not known anymore
+		hits[i].ExternalId, _ = idx.externalId(posting.DocId)
 	}
 
-	idx.scorePosting(resultPhrase)
-
-	result = Union(result, resultPhrase)
-
-	//fmt.Println(result)
-	sort.Sort(ByBoost(result))
-	//fmt.Println("-------------------------------------------------")
-	//fmt.Println(result)
+	return hits
+}
 
-	return result
+// queryTerm is an analyzed query token and the field it is searched in
+type queryTerm struct {
+	field string
+	value string
 }
 
-// Default search
-func (idx *InvertedIndex) Search(q string) []Posting {
-	tokens := idx.analyzer.Analyze(q)
+// key returns the term dictionary key of the query term
+func (t queryTerm) key() string {
+	return fieldTerm(t.field, t.value)
+}
 
-	var result []Posting
-	var temp []Posting
-	var resultPhrase []Posting
+// analyzeQuery splits q on white space, words prefixed with a field name
+// and a colon like "title:foo" are searched in that field and all other
+// words in the default field, consecutive words of the same field are
+// analyzed together with the analyzer of the field
+func (idx *InvertedIndex) analyzeQuery(q string) []queryTerm {
+	terms := make([]queryTerm, 0)
 
-	for i, token := range tokens {
-		if i == 0 {
-			result = make([]Posting, len(idx.index[token.value]))
-			copy(result, idx.index[token.value])
-			//fmt.Println(result)
-			idx.scorePosting(result)
-			//fmt.Println(result)
-		} else {
-			//temp := idx.index[token.value]
-			temp = make([]Posting, len(idx.index[token.value]))
-			copy(temp, idx.index[token.value])
-			idx.scorePosting(temp)
+	field := idx.schema.DefaultField()
+	words := make([]string, 0)
 
-			// boolean AND query
-			result = Intersection(temp, result)
-			// boolean OR query
-			//result = Union(temp, result)
-			// Phrase Query
-			//result = PhraseQuery_FullMatch(result, temp)
+	flush := func() {
+		if len(words) == 0 {
+			return
 		}
-	}
-
-	for i, token := range tokens {
-		if i == 0 {
-			resultPhrase = make([]Posting, len(idx.index[token.value]))
-			copy(resultPhrase, idx.index[token.value])
-			//fmt.Println(result)
-			idx.scorePosting(result)
-			//fmt.Println(result)
-		} else {
-			//temp := idx.index[token.value]
-			temp = make([]Posting, len(idx.index[token.value]))
-			copy(temp, idx.index[token.value])
-			idx.scorePosting(temp)
-
-			// boolean AND query
-			// result = Intersection(temp, result)
-			// boolean OR query
-			//result = Union(temp, result)
-			// Phrase Query
-			resultPhrase = PhraseQuery_FullMatch(resultPhrase, temp)
+		for _, token := range idx.schema.Analyzer(field).Analyze(strings.Join(words, " ")) {
+			terms = append(terms, queryTerm{field, token.value})
 		}
+		words = words[:0]
 	}
 
-	result = Union(result, resultPhrase)
-
-	//fmt.Println(result)
-	sort.Sort(ByBoost(result))
-	//fmt.Println("-------------------------------------------------")
-	//fmt.Println(result)
-
-	return result
-}
-
-func (idx *InvertedIndex) Search_Mixed(q string) []Posting {
-	tokens := idx.analyzer.Analyze(q)
-
-	var result []Posting
-	var resultPhrase []Posting
-	var temp []Posting
-
-	postings := make(map[int][]Posting)
-
-	for i, token := range tokens {
-		if idx.readOnly {
-			postings[i] = ReadPosting_Cdb(token.value)
-			idx.scorePosting(postings[i])
-		} else {
-			postings[i] = make([]Posting, len(idx.index[token.value]))
-			copy(postings[i], idx.index[token.value])
-			idx.scorePosting(postings[i])
-		}
-	}
+	for _, word := range strings.Fields(q) {
+		wordField := idx.schema.DefaultField()
 
-	// Apply AND operation
-	for i := range tokens {
-		if i == 0 {
-			result = postings[i]
-		} else {
-			result = Intersection(result, postings[i])
+		if i := strings.IndexByte(word, ':'); i > 0 && idx.schema.HasField(word[:i]) {
+			wordField = word[:i]
+			word = word[i+1:]
 		}
-	}
 
-	// Apply AND operation
-	for i := range tokens {
-		if i == 0 {
-			resultPhrase = make([]Posting, len(postings[i]))
-			copy(resultPhrase, postings[i])
-			resultPhrase = resetScore(resultPhrase)
-		} else {
-			temp = make([]Posting, len(postings[i]))
-			copy(temp, postings[i])
-			temp = resetScore(temp)
-			resultPhrase = PhraseQuery_FullMatch(resultPhrase, temp)
+		if wordField != field {
+			flush()
+			field = wordField
 		}
+		words = append(words, word)
 	}
+	flush()
 
-	idx.scorePosting(resultPhrase)
-
-	result = Union(result, resultPhrase)
-
-	//fmt.Println(result)
-	sort.Sort(ByBoost(result))
-	//fmt.Println("-------------------------------------------------")
-	//fmt.Println(result)
-
-	return result
+	return terms
 }
 
-func resetScore(postings []Posting) []Posting {
-	for i := range postings {
-		postings[i].Boost = 1.0
-	}
-	return postings
-}
-
-func (idx *InvertedIndex) Search_Mixed_v2(q string) []Posting {
-	tokens := idx.analyzer.Analyze(q)
-
-	var result []Posting
-	var resultPhrase []Posting
-	var temp []Posting
-
-	postings := make(map[int][]Posting)
-
-	for i, token := range tokens {
-		if idx.readOnly {
-			postings[i] = ReadPosting_Cdb(token.value)
-			idx.scorePosting(postings[i])
-		} else {
-			postings[i] = make([]Posting, len(idx.index[token.value]))
-			copy(postings[i], idx.index[token.value])
-			idx.scorePosting(postings[i])
+// searchPhraseSlop is the slop of the phrase added to queries of the Search
+// methods, documents where query terms are closer rank higher
+const searchPhraseSlop = 2
+
+// termsQuery builds the query run by the Search methods, terms of q are
+// combined with op and documents where consecutive terms of a field are
+// near each other score higher, see proximityQuery
+func (idx *InvertedIndex) termsQuery(q string, op Operator) Query {
+	terms := idx.analyzeQuery(q)
+	bq := &BooleanQuery{}
+	var phrases []*PhraseQuery
+
+	phrase := &PhraseQuery{}
+	addPhrase := func() {
+		if len(phrase.Terms) > 1 {
+			phrases = append(phrases, phrase)
 		}
 	}
 
-	// Apply AND operation
-	for i := range tokens {
-		if i == 0 {
-			result = postings[i]
+	for _, term := range terms {
+		tq := &TermQuery{Field: term.field, Term: term.value}
+		if op == OperatorAnd {
+			bq.Must = append(bq.Must, tq)
 		} else {
-			result = Intersection(result, postings[i])
+			bq.Should = append(bq.Should, tq)
 		}
-	}
 
-	// Apply Phrase query scoring only if more than 1 query term exist
-	if len(tokens) > 1 {
-		for i := range tokens {
-			if i == 0 {
-				resultPhrase = make([]Posting, len(postings[i]))
-				copy(resultPhrase, postings[i])
-				//resultPhrase = resetScore(resultPhrase)
-			} else {
-				temp = make([]Posting, len(postings[i]))
-				copy(temp, postings[i])
-				//temp = resetScore(temp)
-				resultPhrase = PhraseQuery_FullMatch(resultPhrase, temp)
-				result = Union(result, resultPhrase)
-			}
+		if term.field != phrase.Field {
+			addPhrase()
+			phrase = &PhraseQuery{Field: term.field, Slop: searchPhraseSlop}
 		}
-		//idx.scorePosting(resultPhrase)
-		//result = Union(result, resultPhrase)
+		phrase.Terms = append(phrase.Terms, term.value)
 	}
+	addPhrase()
 
-	//fmt.Println(result)
-	sort.Sort(ByBoost(result))
-	//fmt.Println("-------------------------------------------------")
-	//fmt.Println(result)
+	if len(phrases) == 0 {
+		return bq
+	}
+	return &proximityQuery{query: bq, phrases: phrases}
+}
 
-	return result
+// Default search, all terms of q must match and documents containing the
+// terms as a phrase rank higher
+func (idx *InvertedIndex) Search(q string) ([]Posting, error) {
+	return idx.Execute(idx.termsQuery(q, OperatorAnd), SearchOptions{})
 }
 
-func (idx *InvertedIndex) SearchOr(q string) []Posting {
-	tokens := idx.analyzer.Analyze(q)
+// SearchOr returns documents matching any term of q, documents containing
+// the terms as a phrase rank higher
+func (idx *InvertedIndex) SearchOr(q string) ([]Posting, error) {
+	return idx.Execute(idx.termsQuery(q, OperatorOr), SearchOptions{})
+}
 
-	var result []Posting
-	var resultPhrase []Posting
-	var temp []Posting
+// Search_Cdb is the same as Search.
+//
+// Deprecated: use Execute with a query
+func (idx *InvertedIndex) Search_Cdb(q string) ([]Posting, error) {
+	return idx.Execute(idx.termsQuery(q, OperatorAnd), SearchOptions{})
+}
 
-	postings := make(map[int][]Posting)
+// Search_Mixed is the same as Search.
+//
+// Deprecated: use Execute with a query
+func (idx *InvertedIndex) Search_Mixed(q string) ([]Posting, error) {
+	return idx.Execute(idx.termsQuery(q, OperatorAnd), SearchOptions{})
+}
 
-	for i, token := range tokens {
-		if idx.readOnly {
-			postings[i] = ReadPosting_Cdb(token.value)
-			idx.scorePosting(postings[i])
-		} else {
-			postings[i] = make([]Posting, len(idx.index[token.value]))
-			copy(postings[i], idx.index[token.value])
-			idx.scorePosting(postings[i])
-		}
-	}
+// Search_Mixed_v2 is the same as Search.
+//
+// Deprecated: use Execute with a query
+func (idx *InvertedIndex) Search_Mixed_v2(q string) ([]Posting, error) {
+	return idx.Execute(idx.termsQuery(q, OperatorAnd), SearchOptions{})
+}
 
-	// Apply OR operation
-	for i := range tokens {
-		if i == 0 {
-			result = postings[i]
-		} else {
-			result = Union(result, postings[i])
+// termPostings returns postings of a term dictionary key without deleted
+// documents, read from every segment on disk if the index is in read only
+// mode. Postings of an in memory index are shared and must not be
+// modified. Positions are read from disk only if withPositions is true
+func (idx *InvertedIndex) termPostings(key string, withPositions bool) ([]Posting, error) {
+	if idx.readOnly {
+		files, err := idx.disk()
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	// Apply Phrase query scoring only if more than 1 query term exist
-	if len(tokens) > 1 {
-		for i := range tokens {
-			if i == 0 {
-				resultPhrase = make([]Posting, len(postings[i]))
-				copy(resultPhrase, postings[i])
-				//resultPhrase = resetScore(resultPhrase)
-			} else {
-				temp = make([]Posting, len(postings[i]))
-				copy(temp, postings[i])
-				//temp = resetScore(temp)
-				resultPhrase = PhraseQuery_FullMatch(resultPhrase, temp)
-				result = Union(result, resultPhrase)
-			}
+		postings, err := files.readPostings(key, withPositions)
+		if err != nil {
+			return nil, err
 		}
-
+		return idx.removeDeleted(postings), nil
 	}
 
-	//fmt.Println(result)
-	sort.Sort(ByBoost(result))
-	//fmt.Println("-------------------------------------------------")
-	//fmt.Println(result)
-
-	return result
+	// postings are shared with the index and never modified by queries
+	return idx.removeDeleted(idx.index[key]), nil
 }
@@ -0,0 +1,552 @@
+package inverted
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/colinmarc/cdb"
+)
+
+// segmentsFile lists the segments of indexes of metadata version 1, later
+// versions list them in the metadata so a commit is a single file
+const segmentsFile = "segments.cdb"
+
+/*
+segment is an immutable part of a persisted index with postings and stored
+fields of the documents in docs. MarshalIndex writes documents added since
+the previous commit as a new segment and segments are merged into larger
+ones by a MergePolicy. DocIds are global to the index so a segment can hold
+any set of documents, its posting lists use the DocIds of the index.
+
+Stored fields of a segment are kept in blocks of documentBlockSize documents
+by the rank of their DocId in docs. Indexes written before segments have a
+single segment of generation 0 holding all documents in index.cdb and
+document.cdb, its document store is missing if it has no stored fields.
+
+Indexes written before documents had fields have an unfielded segment, its
+posting list keys are terms of DefaultField without the field name and its
+document store has the text of documents keyed by DocId.
+*/
+type segment struct {
+	gen  uint64
+	docs *roaring.Bitmap
+
+	unfielded bool
+
+	// size of the files of the segment in bytes
+	size int64
+}
+
+func (s *segment) postingsFile() string {
+	if s.gen == 0 {
+		return "index.cdb"
+	}
+	return fmt.Sprintf("index_%d.cdb", s.gen)
+}
+
+func (s *segment) documentsFile() string {
+	if s.gen == 0 {
+		return "document.cdb"
+	}
+	return fmt.Sprintf("document_%d.cdb", s.gen)
+}
+
+// postingKey returns the key of the posting list of a term dictionary key
+// in the postings file of the segment, false if the segment cannot have it
+func (s *segment) postingKey(key string) (string, bool) {
+	if !s.unfielded {
+		return key, true
+	}
+	field, term := splitFieldTerm(key)
+	return term, field == DefaultField
+}
+
+// dictionaryKey returns the term dictionary key of a posting list key of
+// the postings file of the segment
+func (s *segment) dictionaryKey(key string) string {
+	if s.unfielded {
+		return fieldTerm(DefaultField, key)
+	}
+	return key
+}
+
+// ordinal returns the position of a document of the segment in its document store
+func (s *segment) ordinal(docId uint32) uint32 {
+	return uint32(s.docs.Rank(docId) - 1)
+}
+
+// statSegment sets the size of the segment from its files in dir
+func statSegment(dir string, s *segment) {
+	s.size = 0
+	for _, name := range []string{s.postingsFile(), s.documentsFile()} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			s.size += info.Size()
+		}
+	}
+}
+
+// removeSegment deletes files of a segment, indexes that have them open
+// keep reading them
+func removeSegment(dir string, s *segment) {
+	os.Remove(filepath.Join(dir, s.postingsFile()))
+	os.Remove(filepath.Join(dir, s.documentsFile()))
+}
+
+// serializeSegments writes the generation and documents of every segment
+func serializeSegments(segments []*segment) ([]byte, error) {
+	buf := make([]byte, 0)
+
+	for _, s := range segments {
+		docs, err := s.docs.ToBytes()
+		if err != nil {
+			return nil, err
+		}
+
+		buf = appendUvarint(buf, s.gen)
+		buf = appendUvarint(buf, uint64(len(docs)))
+		buf = append(buf, docs...)
+	}
+
+	return buf, nil
+}
+
+func deserializeSegments(buf []byte) ([]*segment, error) {
+	segments := make([]*segment, 0)
+
+	for len(buf) > 0 {
+		gen, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: truncated segment list", ErrCorruptIndex)
+		}
+		buf = buf[n:]
+
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return nil, fmt.Errorf("%w: truncated segment list", ErrCorruptIndex)
+		}
+		buf = buf[n:]
+
+		docs := roaring.New()
+		if _, err := docs.FromBuffer(buf[:size]); err != nil {
+			return nil, fmt.Errorf("%w: segment %d: %v", ErrCorruptIndex, gen, err)
+		}
+		buf = buf[size:]
+
+		// the bitmap must not share the buffer of the reader
+		segments = append(segments, &segment{gen: gen, docs: docs.Clone()})
+	}
+
+	return segments, nil
+}
+
+// loadSegments reads the segments of the index in dir and the generation of
+// the next segment from the metadata. Indexes written before segments have
+// a single segment with all of their documents
+func loadSegments(dir string) ([]*segment, uint64, error) {
+	metadata, err := cdb.Open(filepath.Join(dir, "metadata.cdb"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer metadata.Close()
+
+	buf, err := metadata.Get([]byte(":generation"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if buf != nil {
+		return readSegmentList(dir, metadata)
+	}
+
+	// indexes of metadata version 1 list their segments in segmentsFile
+	reader, err := cdb.Open(filepath.Join(dir, segmentsFile))
+	if os.IsNotExist(err) {
+		s, err := loadLegacySegment(dir, metadata)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []*segment{s}, 1, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer reader.Close()
+
+	return readSegmentList(dir, reader)
+}
+
+// readSegmentList reads the segments and the generation of the next
+// segment of the index in dir from the ":segments" and ":generation" keys
+func readSegmentList(dir string, reader *cdb.CDB) ([]*segment, uint64, error) {
+	buf, err := reader.Get([]byte(":generation"))
+	if err != nil {
+		return nil, 0, err
+	}
+	generation, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("%w: missing segment generation", ErrCorruptIndex)
+	}
+
+	buf, err = reader.Get([]byte(":segments"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	segments, err := deserializeSegments(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the unfielded segment of an index written before documents had
+	// fields is kept until it is merged
+	unfielded, err := reader.Get([]byte(":unfielded"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, s := range segments {
+		s.unfielded = unfielded != nil && s.gen == 0
+		statSegment(dir, s)
+	}
+
+	return segments, generation, nil
+}
+
+// loadLegacySegment returns the single segment of an index written before
+// segments, it holds every DocId below :docId of the metadata
+func loadLegacySegment(dir string, metadata *cdb.CDB) (*segment, error) {
+	buf, err := readMetadata(metadata, ":docId", 4)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := roaring.New()
+	docs.AddRange(0, uint64(bytesToUint32le(buf)))
+
+	_, unfielded, err := readFields(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segment{gen: 0, docs: docs, unfielded: unfielded}
+	statSegment(dir, s)
+
+	return s, nil
+}
+
+// segmentListProperties returns the metadata listing the segments of the
+// index and the generation of the next segment
+func (idx *InvertedIndex) segmentListProperties() ([]byte, []byte, error) {
+	buf, err := serializeSegments(idx.segments)
+	if err != nil {
+		return nil, nil, err
+	}
+	return appendUvarint(nil, idx.generation), buf, nil
+}
+
+/*
+serializeSegmentList replaces the segments listed in the metadata of the
+last commit with the segments of the index, merges commit merged segments
+with it without committing documents added since. The metadata is replaced
+atomically so the index always refers to complete segments.
+*/
+func (idx *InvertedIndex) serializeSegmentList() error {
+	generation, segments, err := idx.segmentListProperties()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(idx.dir, "metadata.cdb")
+
+	reader, err := cdb.Open(path)
+	if err != nil {
+		return err
+	}
+
+	writer, err := createCDB(path)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	err = writer.Put([]byte(":generation"), generation)
+	if err == nil {
+		err = writer.Put([]byte(":segments"), segments)
+	}
+
+	iter := reader.Iter()
+	for err == nil && iter.Next() {
+		key := string(iter.Key())
+		if key != ":generation" && key != ":segments" {
+			err = writer.Put(iter.Key(), iter.Value())
+		}
+	}
+	if err == nil {
+		err = iter.Err()
+	}
+
+	reader.Close()
+
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	// Close finalizes the database before releasing the file
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	removeSegmentsFile(idx.dir)
+
+	return nil
+}
+
+// removeSegmentsFile removes the segment list of a metadata version 1
+// index once the metadata lists the segments
+func removeSegmentsFile(dir string) {
+	os.Remove(filepath.Join(dir, segmentsFile))
+}
+
+// segmentKeys returns the term dictionary keys of a segment in dir
+func segmentKeys(dir string, s *segment) ([]string, error) {
+	reader, err := cdb.Open(filepath.Join(dir, s.postingsFile()))
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	keys := make([]string, 0)
+
+	iter := reader.Iter()
+	for iter.Next() {
+		// keys of properties like formatKey start with a colon
+		if !strings.HasPrefix(string(iter.Key()), ":") {
+			keys = append(keys, s.dictionaryKey(string(iter.Key())))
+		}
+	}
+
+	return keys, iter.Err()
+}
+
+/*
+writeSegment writes documents in docs as segment gen of the index in dir.
+postings is called with a function adding the posting list of a term
+dictionary key to the segment, posting lists must only have documents in
+docs. document returns stored fields of a document, it is called for every
+document in increasing DocId order.
+*/
+func writeSegment(dir string, gen uint64, docs *roaring.Bitmap, postings func(put func(key string, postings []Posting) error) error, document func(docId uint32) (*Document, error), compress bool) (*segment, error) {
+	s := &segment{gen: gen, docs: docs}
+
+	writer, err := createCDB(filepath.Join(dir, s.postingsFile()))
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Put([]byte(formatKey), []byte{postingFormat})
+	if err == nil {
+		err = postings(func(key string, postings []Posting) error {
+			if len(postings) == 0 {
+				return nil
+			}
+			return writer.Put([]byte(key), encodePostings(postings))
+		})
+	}
+
+	if err != nil {
+		writer.abort()
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeDocumentStore(filepath.Join(dir, s.documentsFile()), docs, document, compress)
+	if err != nil {
+		removeSegment(dir, s)
+		return nil, err
+	}
+
+	statSegment(dir, s)
+
+	return s, nil
+}
+
+// writeDocumentStore writes stored fields of docs in blocks of
+// documentBlockSize documents keyed by block number
+func writeDocumentStore(path string, docs *roaring.Bitmap, document func(docId uint32) (*Document, error), compress bool) error {
+	writer, err := createCDB(path)
+	if err != nil {
+		return err
+	}
+
+	block := make([]*Document, 0, documentBlockSize)
+	blockNum := uint32(0)
+
+	flush := func() error {
+		buf, err := encodeDocumentBlock(block, compress)
+		if err != nil {
+			return err
+		}
+
+		err = writer.Put(uint32ToBytes(blockNum), buf)
+		block = block[:0]
+		blockNum++
+
+		return err
+	}
+
+	iter := docs.Iterator()
+	for iter.HasNext() && err == nil {
+		var doc *Document
+		doc, err = document(iter.Next())
+		if err != nil {
+			break
+		}
+
+		block = append(block, doc)
+		if len(block) == documentBlockSize {
+			err = flush()
+		}
+	}
+
+	if err == nil && len(block) > 0 {
+		err = flush()
+	}
+
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	// Close finalizes the database before releasing the file
+	return writer.Close()
+}
+
+// flushSegment writes documents added since the previous commit as a new
+// segment, postings of deleted documents must have been purged
+func (idx *InvertedIndex) flushSegment() error {
+	pending := idx.newSegment()
+	if pending == nil {
+		return nil
+	}
+
+	s, err := pending.write(idx.dir, idx.compressDocuments)
+	if err != nil {
+		return err
+	}
+
+	idx.addSegment(pending, s)
+	return nil
+}
+
+// pendingSegment holds documents added since the previous commit so they
+// can be written as a segment without holding the lock
+type pendingSegment struct {
+	gen       uint64
+	docs      *roaring.Bitmap
+	postings  map[string][]Posting
+	documents []*Document
+	first     uint32
+	end       uint32
+}
+
+// newSegment takes documents added since the previous commit for segment
+// generation, nil is returned if none of them is live. Postings of deleted
+// documents must have been purged
+func (idx *InvertedIndex) newSegment() *pendingSegment {
+	docs := roaring.New()
+	docs.AddRange(uint64(idx.flushed), uint64(idx.docId))
+	docs.AndNot(idx.deleted)
+
+	if docs.IsEmpty() {
+		idx.flushed = idx.docId
+		return nil
+	}
+
+	// postings are only appended to and replaced by purgeDeleted, the
+	// taken slices stay unchanged once the lock is released
+	postings := make(map[string][]Posting)
+	for key, list := range idx.index {
+		i := sort.Search(len(list), func(i int) bool { return list[i].DocId >= idx.flushed })
+		if i < len(list) {
+			postings[key] = list[i:]
+		}
+	}
+
+	pending := &pendingSegment{
+		gen:       idx.generation,
+		docs:      docs,
+		postings:  postings,
+		documents: append([]*Document(nil), idx.documents[idx.flushed:idx.docId]...),
+		first:     idx.flushed,
+		end:       idx.docId,
+	}
+	idx.generation++
+
+	return pending
+}
+
+// write writes the documents as a segment of the index in dir
+func (p *pendingSegment) write(dir string, compress bool) (*segment, error) {
+	postings := func(put func(key string, postings []Posting) error) error {
+		for key, postings := range p.postings {
+			if err := put(key, postings); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	document := func(docId uint32) (*Document, error) {
+		return p.documents[docId-p.first], nil
+	}
+
+	return writeSegment(dir, p.gen, p.docs, postings, document, compress)
+}
+
+// addSegment adds segment s written from pending to the segments of the
+// index, documents added since pending was taken are not in a segment yet
+func (idx *InvertedIndex) addSegment(pending *pendingSegment, s *segment) {
+	idx.segments = append(idx.segments, s)
+	idx.flushed = pending.end
+}
+
+// mergePostings returns postings of a and b sorted by DocId, documents
+// of a and b are distinct like those of different segments
+func mergePostings(a, b []Posting) []Posting {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+
+	result := make([]Posting, 0, len(a)+len(b))
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].DocId < b[j].DocId {
+			result = append(result, a[i])
+			i++
+		} else {
+			result = append(result, b[j])
+			j++
+		}
+	}
+
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
@@ -1,15 +1,22 @@
 package inverted
 
 import (
-	"errors"
-	"log"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"math"
-	"strconv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/colinmarc/cdb"
 )
 
+// serializePostings encodes postings in postingFormatRaw
 func serializePostings(postings []Posting) []byte {
 	var sizeInBytes uint32 = 0
 
@@ -59,6 +66,7 @@ func serializePostings(postings []Posting) []byte {
 	return buf
 }
 
+// deserializePostings decodes postings of postingFormatRaw
 func deserializePostings(buf []byte) ([]Posting, error) {
 
 	//fmt.Printf("size of buffer=%d\n", len(buf))
@@ -66,7 +74,7 @@ func deserializePostings(buf []byte) ([]Posting, error) {
 	cursor := 0
 
 	if len(buf) < 16 {
-		return nil, errors.New("byte array is too small: " + strconv.Itoa(len(buf)) + " bytes")
+		return nil, fmt.Errorf("%w: posting list is too small: %d bytes", ErrCorruptIndex, len(buf))
 	}
 
 	for {
@@ -74,6 +82,10 @@ func deserializePostings(buf []byte) ([]Posting, error) {
 			break
 		}
 
+		if cursor+12 > len(buf) {
+			return nil, fmt.Errorf("%w: truncated posting at offset %d", ErrCorruptIndex, cursor)
+		}
+
 		posting := Posting{}
 
 		// 4 bytes -> DocId
@@ -88,6 +100,10 @@ func deserializePostings(buf []byte) ([]Posting, error) {
 		posting.Boost = math.Float32frombits(uint32(buf[cursor+0]) | uint32(buf[cursor+1])<<8 | uint32(buf[cursor+2])<<16 | uint32(buf[cursor+3])<<24)
 		cursor += 4
 
+		if uint64(cursor)+uint64(posting.frequency)*4 > uint64(len(buf)) {
+			return nil, fmt.Errorf("%w: truncated positions at offset %d", ErrCorruptIndex, cursor)
+		}
+
 		posting.positions = make([]uint32, posting.frequency)
 
 		for i := 0; i < int(posting.frequency); i++ {
@@ -102,232 +118,926 @@ func deserializePostings(buf []byte) ([]Posting, error) {
 	return postings, nil
 }
 
-// Marshall inverted index to CDB database
+// cdbWriter writes a cdb file to a temporary file that replaces the file
+// on Close, indexes reading or mapping the old file keep reading it
+type cdbWriter struct {
+	*cdb.Writer
+	path string
+}
+
+func createCDB(path string) (*cdbWriter, error) {
+	writer, err := cdb.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &cdbWriter{writer, path}, nil
+}
+
+// Close finalizes the database and replaces the file with it
+func (w *cdbWriter) Close() error {
+	err := w.Writer.Close()
+	if err != nil {
+		os.Remove(w.path + ".tmp")
+		return err
+	}
+	return os.Rename(w.path+".tmp", w.path)
+}
+
+// abort discards the database, the file is not changed
+func (w *cdbWriter) abort() {
+	w.Writer.Close()
+	os.Remove(w.path + ".tmp")
+}
+
+// Marshall inverted index to CDB database, documents added since the
+// previous call are written as a new segment. If background merges were
+// stopped by an error that was not returned yet, it is returned instead
+// and the index is written by the next call. The segment is written
+// without holding the lock so the index can be searched and modified
+// meanwhile, documents added meanwhile are written under the lock
 func (idx *InvertedIndex) MarshalIndex() error {
+	idx.commitMu.Lock()
+	defer idx.commitMu.Unlock()
+
+	idx.mu.Lock()
+
 	if idx.readOnly {
-		log.Println("index is in 'read only' mode hence cannot be marshalled to disk")
-		return errors.New("index is in 'read only' mode")
+		idx.mu.Unlock()
+		return ErrReadOnly
+	}
+
+	// segments a background merge failed to merge are left as they are
+	if err := idx.takeMergeErr(); err != nil {
+		idx.mu.Unlock()
+		return err
+	}
+
+	idx.purgeDeleted()
+	pending := idx.newSegment()
+	dir, compress := idx.dir, idx.compressDocuments
+	idx.mu.Unlock()
+
+	var s *segment
+	if pending != nil {
+		var err error
+		s, err = pending.write(dir, compress)
+		if err != nil {
+			return err
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if s != nil {
+		idx.addSegment(pending, s)
 	}
 
 	// update index statitistics and make sure
 	// document categories are updated
-	idx.UpdateAvgFieldLen()
-	idx.BuildCategoryBitmap()
+	idx.updateAvgFieldLen()
+	idx.buildCategoryBitmap()
+	idx.purgeDeleted()
+	idx.computeTermStats()
 
-	err := idx.serializeIndex()
+	err := idx.flushSegment()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 
 	err = idx.serializeDocumentCategories()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
 
+	// the metadata lists the segments and is written last so the index
+	// refers to a new segment only after the rest of the commit is on disk
 	err = idx.serializeIndexMetadata()
 	if err != nil {
-		log.Println(err)
 		return err
 	}
+	removeSegmentsFile(idx.dir)
 
 	// use committed flag to signal if index committed to disk
 	idx.commited = true
+	idx.committedDeleted = idx.deleted.Clone()
+
+	idx.maybeMerge()
 
 	return nil
 }
 
+// metadataVersion is the layout of index files written by MarshalIndex,
+// stored as ":version". Indexes written before the layout was versioned
+// have version 0, metadata added since is optional for them. Indexes of
+// version 1 list their segments in segmentsFile instead of the metadata
+const metadataVersion = 2
+
 // Serialize term=>postings dictionary to CDB database
-func (idx *InvertedIndex) serializeIndex() error {
+func (idx *InvertedIndex) serializeIndexMetadata() error {
 
-	writer, err := cdb.Create("data/index.cdb")
+	writer, err := createCDB(filepath.Join(idx.dir, "metadata.cdb"))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	for k, v := range idx.index {
-		buf := serializePostings(v)
-		writer.Put([]byte(k), buf)
+	// Now serialize other index properties to CDB file as key => value pair
+	// in order to differenciate terms and properties, properties are prepended with a colon ":"
+	type property struct {
+		key   string
+		value []byte
 	}
 
-	writer.Freeze()
-	writer.Close()
-
-	return nil
-}
+	fields := make([]string, 0, len(idx.fieldLen))
+	for field := range idx.fieldLen {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
 
-// Serialize term=>postings dictionary to CDB database
-func (idx *InvertedIndex) serializeIndexMetadata() error {
+	deleted, err := idx.deleted.ToBytes()
+	if err != nil {
+		writer.abort()
+		return err
+	}
 
-	writer, err := cdb.Create("data/metadata.cdb")
+	generation, segments, err := idx.segmentListProperties()
 	if err != nil {
-		log.Fatal(err)
+		writer.abort()
+		return err
 	}
 
-	// Now serialize other index properties to CDB file as key => value pair
-	// in order to differenciate terms and properties, properties are prepended with a colon ":"
+	properties := []property{
+		{":version", uint32ToBytes(metadataVersion)},
+		{":docId", uint32ToBytes(idx.docId)},
+		{":NumDocs", uint32ToBytes(idx.NumDocs)},
+		{":fields", []byte(strings.Join(fields, "\n"))},
+		{":deleted", deleted},
+		{":externalIds", serializeStrings(idx.externalIds)},
+		{":externalIdOffsets", stringOffsets(idx.externalIds)},
+		{":terms", serializeTerms(idx.termDictionary())},
+		{":termOffsets", termOffsets(idx.termDictionary())},
+		{":generation", generation},
+		{":segments", segments},
+	}
 
-	buf := uint32ToBytes(idx.docId)
-	writer.Put([]byte(":docId"), buf)
+	// indexes searched from mapped files look up DocIds of external ids
+	for externalId, docId := range idx.docIds {
+		properties = append(properties, property{":id:" + externalId, uint32ToBytes(docId)})
+	}
 
-	buf = uint32ToBytes(idx.NumDocs)
-	writer.Put([]byte(":NumDocs"), buf)
+	for _, s := range idx.segments {
+		if s.unfielded {
+			properties = append(properties, property{":unfielded", []byte{1}})
+			break
+		}
+	}
 
-	buf = float64ToBytes(idx.avgFieldLen)
-	writer.Put([]byte(":avgFieldLen"), buf)
-	log.Printf("avgFieldLen=%f\n", idx.avgFieldLen)
+	// field statistics are stored for every field as ":avgFieldLen:title"
+	for _, field := range fields {
+		properties = append(properties,
+			property{":avgFieldLen:" + field, float64ToBytes(idx.avgFieldLen[field])},
+			property{":fieldLen:" + field, serializeFieldLen(idx.fieldLen[field])},
+			property{":sumFieldLen:" + field, float64ToBytes(idx.sumFieldLen[field])},
+			property{":norms:" + field, idx.norms[field]},
+			property{":similarity:" + field, []byte(idx.boundSimilarity[field])},
+		)
+	}
 
-	buf = idx.serializeFieldLen()
-	writer.Put([]byte(":fieldLen"), buf)
+	for _, p := range properties {
+		err = writer.Put([]byte(p.key), p.value)
+		if err != nil {
+			writer.abort()
+			return err
+		}
+	}
 
-	writer.Freeze()
-	writer.Close()
+	// Close finalizes the database before releasing the file
+	return writer.Close()
+}
 
-	return nil
+// ReadPosting_Cdb reads postings of a term from every segment of the index
+// persisted in dir, an empty posting list is returned if the term does not
+// exist. Deleted documents are not removed. The index files are opened on
+// every call, an open InvertedIndex keeps them open instead
+func ReadPosting_Cdb(dir, term string) ([]Posting, error) {
+
+	files, err := openSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer files.close()
+
+	return files.readPostings(term, true)
 }
 
-func ReadPosting_Cdb(term string) []Posting {
+// openSegments opens files of all segments of the index persisted in dir
+func openSegments(dir string) (*diskIndex, error) {
+	segments, _, err := loadSegments(dir)
+	if err != nil {
+		return nil, err
+	}
 
-	reader, err := cdb.Open("data/index.cdb")
+	return openDiskIndex(dir, segments, false)
+}
+
+// stored fields are persisted in blocks of documentBlockSize documents keyed
+// by block number, the first byte of a block tells how the block is encoded
+const documentBlockSize = 16
+
+const (
+	blockRaw   byte = 0
+	blockFlate byte = 1
+)
+
+// ReadDocument_Cdb reads stored fields of a document from the segment of
+// the index in dir holding it. The index files are opened on every call, an
+// open InvertedIndex keeps them open instead
+func ReadDocument_Cdb(dir string, docId uint32) (*Document, error) {
+
+	files, err := openSegments(dir)
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 
-	defer reader.Close()
+	defer files.close()
+
+	return files.document(docId)
+}
 
-	buf, err := reader.Get([]byte(term))
+// readDocument reads stored fields of the document at ordinal in a
+// document store
+func readDocument(reader cdbReader, ordinal uint32) (*Document, error) {
+	buf, err := reader.Get(uint32ToBytes(ordinal / documentBlockSize))
 	if err != nil {
-		log.Println(err)
+		return nil, err
 	}
 
-	// if term is not found in datebase then return emty posting
 	if buf == nil {
-		return make([]Posting, 0)
+		return nil, ErrNotFound
 	}
 
-	postings, err := deserializePostings(buf)
+	docs, err := decodeDocumentBlock(buf)
 	if err != nil {
-		log.Println(err)
+		return nil, err
+	}
+
+	i := int(ordinal % documentBlockSize)
+	if i >= len(docs) {
+		return nil, ErrNotFound
 	}
 
-	return postings
+	return docs[i], nil
 }
 
-func ReadDocument_Cdb(docId uint32) (string, error) {
+// loadDocuments reads stored fields of all documents from every segment
+// into memory, deleted documents have no fields
+func (idx *InvertedIndex) loadDocuments() ([]*Document, error) {
+
+	documents := make([]*Document, idx.docId)
+
+	for _, s := range idx.segments {
+		err := loadSegmentDocuments(filepath.Join(idx.dir, s.documentsFile()), s, documents)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	reader, err := cdb.Open("data/document.cdb")
+	for docId := range documents {
+		if documents[docId] == nil || idx.deleted.Contains(uint32(docId)) {
+			documents[docId] = NewDocument()
+		}
+	}
+
+	return documents, nil
+}
+
+// loadSegmentDocuments reads stored fields of documents of a segment into
+// documents indexed by DocId
+func loadSegmentDocuments(path string, s *segment, documents []*Document) error {
+
+	reader, err := cdb.Open(path)
+	if s.gen == 0 && os.IsNotExist(err) {
+		// written before stored fields were persisted by the library
+		return nil
+	}
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
 	defer reader.Close()
 
-	buf, err := reader.Get([]byte(uint32ToBytes(docId)))
+	if s.unfielded {
+		iter := s.docs.Iterator()
+		for iter.HasNext() {
+			docId := iter.Next()
+
+			buf, err := reader.Get(uint32ToBytes(docId))
+			if err != nil {
+				return err
+			}
+
+			if buf != nil && docId < uint32(len(documents)) {
+				documents[docId] = NewDocument().AddField(DefaultField, string(buf))
+			}
+		}
+		return nil
+	}
+
+	var docs []*Document
+	ordinal := uint32(0)
+
+	iter := s.docs.Iterator()
+	for iter.HasNext() {
+		docId := iter.Next()
+
+		if ordinal%documentBlockSize == 0 {
+			block := ordinal / documentBlockSize
+
+			buf, err := reader.Get(uint32ToBytes(block))
+			if err != nil {
+				return err
+			}
+
+			if buf == nil {
+				return fmt.Errorf("%w: missing document block %d", ErrCorruptIndex, block)
+			}
+
+			docs, err = decodeDocumentBlock(buf)
+			if err != nil {
+				return err
+			}
+		}
+
+		i := int(ordinal % documentBlockSize)
+		if i >= len(docs) {
+			return fmt.Errorf("%w: missing document %d", ErrCorruptIndex, docId)
+		}
+
+		if docId < uint32(len(documents)) {
+			documents[docId] = docs[i]
+		}
+		ordinal++
+	}
+
+	return nil
+}
+
+// encodeDocumentBlock writes number of fields of each document followed by
+// length prefixed field names and values, optionally flate compressed
+func encodeDocumentBlock(docs []*Document, compress bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+
+	putString := func(s string) {
+		n := binary.PutUvarint(tmp[:], uint64(len(s)))
+		buf.Write(tmp[:n])
+		buf.WriteString(s)
+	}
+
+	for _, doc := range docs {
+		n := binary.PutUvarint(tmp[:], uint64(len(doc.Fields)))
+		buf.Write(tmp[:n])
+
+		for _, f := range doc.Fields {
+			putString(f.Name)
+			putString(f.Value)
+		}
+	}
+
+	if !compress {
+		return append([]byte{blockRaw}, buf.Bytes()...), nil
+	}
+
+	var out bytes.Buffer
+	out.WriteByte(blockFlate)
+
+	fw, err := flate.NewWriter(&out, flate.DefaultCompression)
 	if err != nil {
-		log.Println(err)
-		return "", err
+		return nil, err
 	}
 
-	return string(buf), nil
+	_, err = fw.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	err = fw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
 }
 
-func loadTermDictionary() (map[string][]Posting, error) {
+func decodeDocumentBlock(buf []byte) ([]*Document, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%w: empty document block", ErrCorruptIndex)
+	}
+
+	data := buf[1:]
+
+	switch buf[0] {
+	case blockRaw:
+	case blockFlate:
+		var err error
+		data, err = io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: document block: %v", ErrCorruptIndex, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown document block encoding %d", ErrCorruptIndex, buf[0])
+	}
+
+	cursor := 0
+
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data[cursor:])
+		if n <= 0 {
+			return 0, fmt.Errorf("%w: truncated document block", ErrCorruptIndex)
+		}
+		cursor += n
+		return v, nil
+	}
+
+	readString := func() (string, error) {
+		size, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if uint64(len(data)-cursor) < size {
+			return "", fmt.Errorf("%w: truncated document block", ErrCorruptIndex)
+		}
+		s := string(data[cursor : cursor+int(size)])
+		cursor += int(size)
+		return s, nil
+	}
+
+	docs := make([]*Document, 0, documentBlockSize)
+
+	for cursor < len(data) {
+		numFields, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+
+		doc := NewDocument()
+		for i := uint64(0); i < numFields; i++ {
+			name, err := readString()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := readString()
+			if err != nil {
+				return nil, err
+			}
+
+			doc.AddField(name, value)
+		}
+
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// loadTermDictionary reads posting lists of every segment into memory
+// without deleted documents
+func (idx *InvertedIndex) loadTermDictionary() (map[string][]Posting, error) {
 
 	index := make(map[string][]Posting)
 
-	reader, err := cdb.Open("data/index.cdb")
+	for _, s := range idx.segments {
+		err := idx.loadSegmentTerms(s, index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// loadTerms builds the term dictionary from posting lists of every segment,
+// it is used for indexes written before the dictionary was persisted
+func (idx *InvertedIndex) loadTerms() ([]Term, error) {
+
+	stats := make(map[string]*Term)
+
+	for _, s := range idx.segments {
+		err := idx.loadSegmentTermStats(s, stats)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	terms := make([]Term, 0, len(stats))
+	for _, term := range stats {
+		terms = append(terms, *term)
+	}
+	sort.Sort(ByValue(terms))
+
+	return terms, nil
+}
+
+// loadSegmentTermStats adds document and term frequencies of terms of a
+// segment without deleted documents to stats
+func (idx *InvertedIndex) loadSegmentTermStats(s *segment, stats map[string]*Term) error {
+
+	reader, err := cdb.Open(filepath.Join(idx.dir, s.postingsFile()))
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
 	defer reader.Close()
 
+	format, err := readPostingFormat(reader)
+	if err != nil {
+		return err
+	}
+
 	iter := reader.Iter()
 	for iter.Next() {
-		postings, err := deserializePostings(iter.Value())
+		if strings.HasPrefix(string(iter.Key()), ":") {
+			continue
+		}
+
+		key := s.dictionaryKey(string(iter.Key()))
+
+		postings, err := decodePostings(iter.Value(), format, false)
 		if err != nil {
-			log.Println(err)
+			return fmt.Errorf("term %q: %w", key, err)
+		}
 
-			return index, err
+		postings = idx.removeDeleted(postings)
+		if len(postings) == 0 {
+			continue
 		}
 
-		index[string(iter.Key())] = postings
+		term := stats[key]
+		if term == nil {
+			term = &Term{Value: key}
+			stats[term.Value] = term
+		}
+
+		term.DocFreq += uint32(len(postings))
+		for _, p := range postings {
+			term.TotalTermFreq += uint64(p.frequency)
+		}
 	}
 
-	return index, nil
+	return iter.Err()
+}
+
+// loadSegmentTerms adds posting lists of a segment to index
+func (idx *InvertedIndex) loadSegmentTerms(s *segment, index map[string][]Posting) error {
+
+	reader, err := cdb.Open(filepath.Join(idx.dir, s.postingsFile()))
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	format, err := readPostingFormat(reader)
+	if err != nil {
+		return err
+	}
+
+	iter := reader.Iter()
+	for iter.Next() {
+		if strings.HasPrefix(string(iter.Key()), ":") {
+			continue
+		}
+
+		key := s.dictionaryKey(string(iter.Key()))
+
+		postings, err := decodePostings(iter.Value(), format, true)
+		if err != nil {
+			return fmt.Errorf("term %q: %w", key, err)
+		}
+
+		postings = idx.removeDeleted(postings)
+		if len(postings) > 0 {
+			index[key] = mergePostings(index[key], postings)
+		}
+	}
+
+	return iter.Err()
 }
 
+// LoadIndexMetadata reads index statistics persisted by MarshalIndex
 func (idx *InvertedIndex) LoadIndexMetadata() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
 
-	reader, err := cdb.Open("data/metadata.cdb")
+	reader, err := cdb.Open(filepath.Join(idx.dir, "metadata.cdb"))
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
 	defer reader.Close()
 
-	buf, err := reader.Get([]byte(":docId"))
+	buf, err := reader.Get([]byte(":version"))
+	if err != nil {
+		return err
+	}
+
+	version := uint32(0)
+	if buf != nil {
+		if len(buf) != 4 {
+			return fmt.Errorf("%w: metadata \":version\" is %d bytes", ErrCorruptIndex, len(buf))
+		}
+		version = bytesToUint32le(buf)
+	}
+
+	if version > metadataVersion {
+		return fmt.Errorf("%w: index version %d is newer than %d", ErrIndexVersion, version, metadataVersion)
+	}
+
+	// optional reads metadata that indexes of version 0 may not have,
+	// nil is returned if they do not
+	optional := func(key string, size int) ([]byte, error) {
+		if version == 0 {
+			buf, err := reader.Get([]byte(key))
+			if err != nil || buf == nil {
+				return nil, err
+			}
+		}
+		return readMetadata(reader, key, size)
+	}
+
+	buf, err = readMetadata(reader, ":docId", 4)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 	idx.docId = bytesToUint32le(buf)
-	log.Printf("docId=%d\n", idx.docId)
 
-	buf, err = reader.Get([]byte(":NumDocs"))
+	buf, err = readMetadata(reader, ":NumDocs", 4)
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 	idx.NumDocs = bytesToUint32le(buf)
-	log.Printf("NumDocs=%d\n", idx.NumDocs)
 
-	buf, err = reader.Get([]byte(":avgFieldLen"))
+	idx.deleted = roaring.NewBitmap()
+
+	buf, err = optional(":deleted", 0)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+
+	if buf != nil {
+		_, err = idx.deleted.FromBuffer(buf)
+		if err != nil {
+			return fmt.Errorf("%w: deleted documents: %v", ErrCorruptIndex, err)
+		}
+	}
+
+	// indexes searched from mapped files look up external ids and terms
+	// in the mapped metadata instead of loading them
+	if idx.metadata != nil {
+		idx.metadata.close()
+		idx.metadata = nil
 	}
-	idx.avgFieldLen = bytesToFloat64(buf)
-	log.Printf("avgFieldLen=%f\n", idx.avgFieldLen)
 
-	buf, err = reader.Get([]byte(":fieldLen"))
+	if idx.memoryMap {
+		idx.metadata, err = openMappedMetadata(filepath.Join(idx.dir, "metadata.cdb"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if idx.metadata != nil {
+		if uint32(idx.metadata.numExternalIds()) != idx.docId {
+			idx.metadata.close()
+			idx.metadata = nil
+			return fmt.Errorf("%w: external ids do not match %d documents", ErrCorruptIndex, idx.docId)
+		}
+
+		idx.externalIds, idx.docIds, idx.terms = nil, nil, nil
+
+		err = idx.loadFieldStats(reader, optional)
+		if err != nil {
+			idx.metadata.close()
+			idx.metadata = nil
+		}
+		return err
+	}
+
+	buf, err = optional(":externalIds", 0)
+	if err != nil {
+		return err
+	}
+
+	idx.externalIds = make([]string, idx.docId)
+	if buf != nil {
+		idx.externalIds, err = deserializeStrings(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if uint32(len(idx.externalIds)) != idx.docId {
+		return fmt.Errorf("%w: %d external ids for %d documents", ErrCorruptIndex, len(idx.externalIds), idx.docId)
+	}
+
+	idx.buildDocIds()
+
+	// the term dictionary of indexes without one is built from their
+	// segments when the index is opened
+	buf, err = optional(":terms", 0)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+
+	idx.terms = nil
+	if buf != nil {
+		idx.terms, err = deserializeTerms(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return idx.loadFieldStats(reader, optional)
+}
+
+// loadFieldStats reads length statistics, norms and similarities of fields,
+// optional reads metadata that indexes of version 0 may not have
+func (idx *InvertedIndex) loadFieldStats(reader *cdb.CDB, optional func(key string, size int) ([]byte, error)) error {
+	fields, unfielded, err := readFields(reader)
+	if err != nil {
+		return err
+	}
+
+	var buf []byte
+	idx.fieldLen = make(map[string][]uint32)
+	idx.avgFieldLen = make(map[string]float64)
+	idx.sumFieldLen = make(map[string]float64)
+	idx.lengthDocId = idx.docId
+	idx.norms = make(map[string][]byte)
+	idx.boundSimilarity = make(map[string]string)
+
+	for _, field := range fields {
+		buf, err = readMetadata(reader, fieldKey(":avgFieldLen:", field, unfielded), 8)
+		if err != nil {
+			return err
+		}
+		idx.avgFieldLen[field] = bytesToFloat64(buf)
+
+		sumFieldLen, err := optional(":sumFieldLen:"+field, 8)
+		if err != nil {
+			return err
+		}
+
+		norms, err := optional(":norms:"+field, 0)
+		if err != nil {
+			return err
+		}
+
+		if sumFieldLen == nil || norms == nil {
+			// recomputed from exact field lengths
+			buf, err = readMetadata(reader, fieldKey(":fieldLen:", field, unfielded), 0)
+			if err != nil {
+				return err
+			}
+
+			fieldLen, err := deserializeFieldLen(buf)
+			if err != nil {
+				return err
+			}
+
+			sum := 0.0
+			norms = make([]byte, len(fieldLen))
+			for docId, length := range fieldLen {
+				if !idx.deleted.Contains(uint32(docId)) {
+					sum += float64(length)
+				}
+				norms[docId] = encodeNorm(length)
+			}
+			sumFieldLen = float64ToBytes(sum)
+		}
+
+		idx.sumFieldLen[field] = bytesToFloat64(sumFieldLen)
+		idx.norms[field] = norms
+
+		// scores of indexes without a similarity have no upper bounds
+		buf, err = optional(":similarity:"+field, 0)
+		if err != nil {
+			return err
+		}
+		idx.boundSimilarity[field] = string(buf)
 	}
-	idx.fieldLen = deserializeFieldLen(buf)
 
 	return nil
 }
 
+// loadFieldLen reads exact field lengths needed to update statistics of an
+// index that can be modified, read only indexes score with norms only
+func loadFieldLen(dir string) (map[string][]uint32, error) {
+	reader, err := cdb.Open(filepath.Join(dir, "metadata.cdb"))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	fields, unfielded, err := readFields(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	fieldLen := make(map[string][]uint32)
+	for _, field := range fields {
+		buf, err := readMetadata(reader, fieldKey(":fieldLen:", field, unfielded), 0)
+		if err != nil {
+			return nil, err
+		}
+		fieldLen[field], err = deserializeFieldLen(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fieldLen, nil
+}
+
+// readFields reads names of fields with length statistics in the metadata,
+// indexes written before documents had fields have lengths of their text in
+// DefaultField and unfielded is true
+func readFields(reader *cdb.CDB) (fields []string, unfielded bool, err error) {
+	buf, err := reader.Get([]byte(":fields"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if buf == nil {
+		if _, err = readMetadata(reader, ":fieldLen", 0); err != nil {
+			return nil, false, err
+		}
+		return []string{DefaultField}, true, nil
+	}
+
+	if len(buf) == 0 {
+		return nil, false, nil
+	}
+	return strings.Split(string(buf), "\n"), false, nil
+}
+
+// fieldKey returns the metadata key of a statistic of field, the statistics
+// of unfielded indexes have no field name
+func fieldKey(prefix, field string, unfielded bool) string {
+	if unfielded {
+		return strings.TrimSuffix(prefix, ":")
+	}
+	return prefix + field
+}
+
+// readMetadata reads a metadata property and makes sure it has at least size bytes
+func readMetadata(reader *cdb.CDB, key string, size int) ([]byte, error) {
+	buf, err := reader.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if buf == nil {
+		return nil, fmt.Errorf("%w: missing metadata %q", ErrCorruptIndex, key)
+	}
+
+	if len(buf) < size {
+		return nil, fmt.Errorf("%w: metadata %q is too small: %d bytes", ErrCorruptIndex, key, len(buf))
+	}
+
+	return buf, nil
+}
+
 // Marshall term=>postings dictionary to CDB database
 func (idx *InvertedIndex) serializeDocumentCategories() error {
-	writer, err := cdb.Create("data/categories.cdb")
-
+	writer, err := createCDB(filepath.Join(idx.dir, "categories.cdb"))
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
 
 	for key, value := range idx.categoryBitmaps {
 
 		buf, err := value.ToBytes()
+		if err == nil {
+			err = writer.Put([]byte(key), buf)
+		}
+
 		if err != nil {
-			log.Panicln(err)
+			writer.abort()
 			return err
 		}
-		writer.Put([]byte(key), buf)
 	}
 
-	writer.Freeze()
-	writer.Close()
-
-	return nil
+	// Close finalizes the database before releasing the file
+	return writer.Close()
 }
 
 // Marshall term=>postings dictionary to CDB database
-func deserializeDocumentCategories() (map[string]*roaring.Bitmap, error) {
+func deserializeDocumentCategories(dir string) (map[string]*roaring.Bitmap, error) {
 
-	reader, err := cdb.Open("data/categories.cdb")
+	reader, err := cdb.Open(filepath.Join(dir, "categories.cdb"))
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
@@ -340,21 +1050,156 @@ func deserializeDocumentCategories() (map[string]*roaring.Bitmap, error) {
 		rb := roaring.New()
 		_, err = rb.FromBuffer(iter.Value())
 		if err != nil {
-			log.Println(err)
-			return nil, err
+			return nil, fmt.Errorf("%w: category %q: %v", ErrCorruptIndex, iter.Key(), err)
 		}
 
 		categoryBitmaps[string(iter.Key())] = rb
 	}
 
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
 	return categoryBitmaps, nil
 }
 
-func (idx *InvertedIndex) serializeFieldLen() []byte {
-	buf := make([]byte, len(idx.fieldLen)*4)
+// serializeStrings writes each string prefixed with its length as uvarint
+func serializeStrings(values []string) []byte {
+	buf := make([]byte, 0, len(values)*8)
+	var tmp [binary.MaxVarintLen64]byte
+
+	for _, v := range values {
+		n := binary.PutUvarint(tmp[:], uint64(len(v)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, v...)
+	}
+
+	return buf
+}
+
+func deserializeStrings(buf []byte) ([]string, error) {
+	values := make([]string, 0)
+
+	cursor := 0
+	for cursor < len(buf) {
+		value, n, err := decodeString(buf[cursor:])
+		if err != nil {
+			return nil, err
+		}
+		cursor += n
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// decodeString decodes a string written by serializeStrings at the start of
+// buf and returns the number of bytes read
+func decodeString(buf []byte) (string, int, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return "", 0, fmt.Errorf("%w: truncated string list", ErrCorruptIndex)
+	}
+
+	return string(buf[n : n+int(size)]), n + int(size), nil
+}
+
+// stringOffsets returns offsets of values written by serializeStrings
+func stringOffsets(values []string) []byte {
+	sizes := make([]int, len(values))
+	for i, v := range values {
+		sizes[i] = uvarintSize(uint64(len(v))) + len(v)
+	}
+	return recordOffsets(sizes)
+}
+
+// serializeTerms writes the sorted term dictionary, each term is written as
+// uvarint length of the value, the value and uvarint document frequency
+func serializeTerms(terms []Term) []byte {
+	buf := make([]byte, 0, len(terms)*16)
+	var tmp [binary.MaxVarintLen64]byte
+
+	for _, term := range terms {
+		n := binary.PutUvarint(tmp[:], uint64(len(term.Value)))
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, term.Value...)
+		n = binary.PutUvarint(tmp[:], uint64(term.DocFreq))
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp[:], term.TotalTermFreq)
+		buf = append(buf, tmp[:n]...)
+		buf = append(buf, uint32ToBytes(math.Float32bits(term.MaxScore))...)
+	}
+
+	return buf
+}
+
+func deserializeTerms(buf []byte) ([]Term, error) {
+	terms := make([]Term, 0)
 
 	cursor := 0
-	for _, v := range idx.fieldLen {
+	for cursor < len(buf) {
+		term, n, err := decodeTerm(buf[cursor:])
+		if err != nil {
+			return nil, err
+		}
+		cursor += n
+
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+// decodeTerm decodes a term written by serializeTerms at the start of buf
+// and returns the number of bytes read
+func decodeTerm(buf []byte) (Term, int, error) {
+	size, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < size {
+		return Term{}, 0, fmt.Errorf("%w: truncated term dictionary", ErrCorruptIndex)
+	}
+	cursor := n
+
+	term := Term{Value: string(buf[cursor : cursor+int(size)])}
+	cursor += int(size)
+
+	docFreq, n := binary.Uvarint(buf[cursor:])
+	if n <= 0 {
+		return Term{}, 0, fmt.Errorf("%w: truncated term dictionary", ErrCorruptIndex)
+	}
+	cursor += n
+	term.DocFreq = uint32(docFreq)
+
+	term.TotalTermFreq, n = binary.Uvarint(buf[cursor:])
+	if n <= 0 {
+		return Term{}, 0, fmt.Errorf("%w: truncated term dictionary", ErrCorruptIndex)
+	}
+	cursor += n
+
+	if len(buf)-cursor < 4 {
+		return Term{}, 0, fmt.Errorf("%w: truncated term dictionary", ErrCorruptIndex)
+	}
+	term.MaxScore = math.Float32frombits(bytesToUint32le(buf[cursor:]))
+	cursor += 4
+
+	return term, cursor, nil
+}
+
+// termOffsets returns offsets of terms written by serializeTerms
+func termOffsets(terms []Term) []byte {
+	sizes := make([]int, len(terms))
+	for i, term := range terms {
+		sizes[i] = uvarintSize(uint64(len(term.Value))) + len(term.Value) +
+			uvarintSize(uint64(term.DocFreq)) + uvarintSize(term.TotalTermFreq) + 4
+	}
+	return recordOffsets(sizes)
+}
+
+func serializeFieldLen(fieldLen []uint32) []byte {
+	buf := make([]byte, len(fieldLen)*4)
+
+	cursor := 0
+	for _, v := range fieldLen {
 		buf[cursor+0] = byte(v >> 0)
 		buf[cursor+1] = byte(v >> 8)
 		buf[cursor+2] = byte(v >> 16)
@@ -365,7 +1210,11 @@ func (idx *InvertedIndex) serializeFieldLen() []byte {
 	return buf
 }
 
-func deserializeFieldLen(buf []byte) []uint32 {
+func deserializeFieldLen(buf []byte) ([]uint32, error) {
+
+	if len(buf)%4 != 0 {
+		return nil, fmt.Errorf("%w: field length data has %d bytes", ErrCorruptIndex, len(buf))
+	}
 
 	fieldLen := make([]uint32, len(buf)/4)
 
@@ -382,5 +1231,5 @@ func deserializeFieldLen(buf []byte) []uint32 {
 		index += 1
 	}
 
-	return fieldLen
+	return fieldLen, nil
 }
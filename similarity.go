@@ -0,0 +1,248 @@
+package inverted
+
+import (
+	"fmt"
+	"math"
+)
+
+// TermStats are collection statistics of a term in a field used for scoring
+type TermStats struct {
+	DocCount      float64 // number of documents in the index
+	DocFreq       float64 // number of documents containing the term
+	TotalTermFreq float64 // number of occurrences of the term in all documents
+	AvgFieldLen   float64 // average length of the field in tokens
+	SumFieldLen   float64 // number of tokens of the field in all documents
+}
+
+// Similarity scores documents matching a term
+type Similarity interface {
+	// Scorer returns a scorer of documents containing a term, it is called
+	// once per term of a query and should precompute everything that does
+	// not depend on a single document
+	Scorer(stats *TermStats) TermScorer
+}
+
+// TermScorer scores documents containing a single term
+type TermScorer interface {
+	// Score returns the score of a document containing the term freq times
+	// in a field whose length is encoded in norm, see decodeNorm
+	Score(freq float64, norm byte) float64
+
+	// MaxScore returns an upper bound of Score for any document, freq is
+	// never greater than maxNormError times the decoded length
+	MaxScore() float64
+}
+
+// DefaultSimilarity is used by fields and indexes without a Similarity
+var DefaultSimilarity Similarity = BM25{K1: 1.2, B: 0.75}
+
+// normCache computes a length dependent factor for all norm values
+func normCache(f func(fieldLen float64) float64) *[256]float64 {
+	var cache [256]float64
+	for i, fieldLen := range normTable {
+		cache[i] = f(fieldLen)
+	}
+	return &cache
+}
+
+// TFIDF is the classic vector space similarity of Lucene, the square root
+// of term frequency multiplied by the square of idf and normalized by the
+// square root of field length
+type TFIDF struct{}
+
+type tfidfScorer struct {
+	weight float64
+	cache  *[256]float64
+}
+
+func (TFIDF) Scorer(stats *TermStats) TermScorer {
+	idf := 1 + math.Log((stats.DocCount+1)/(stats.DocFreq+1))
+
+	return &tfidfScorer{
+		weight: idf * idf,
+		cache: normCache(func(fieldLen float64) float64 {
+			return 1 / math.Sqrt(math.Max(fieldLen, 1))
+		}),
+	}
+}
+
+func (s *tfidfScorer) Score(freq float64, norm byte) float64 {
+	return math.Sqrt(freq) * s.weight * s.cache[norm]
+}
+
+func (s *tfidfScorer) MaxScore() float64 {
+	return s.weight * math.Sqrt(maxNormError)
+}
+
+// LMDirichlet is a language model similarity with Dirichlet smoothing, Mu is
+// the amount of smoothing towards the collection model, usually 2000.
+// Scores of documents that would be negative are zero
+type LMDirichlet struct {
+	Mu float64
+}
+
+type lmDirichletScorer struct {
+	mu float64
+
+	// probability of the term in the whole field
+	p     float64
+	cache *[256]float64
+}
+
+func (s LMDirichlet) Scorer(stats *TermStats) TermScorer {
+	return &lmDirichletScorer{
+		mu: s.Mu,
+		p:  (stats.TotalTermFreq + 1) / (stats.SumFieldLen + 1),
+		cache: normCache(func(fieldLen float64) float64 {
+			return math.Log(s.Mu / (fieldLen + s.Mu))
+		}),
+	}
+}
+
+func (s *lmDirichletScorer) Score(freq float64, norm byte) float64 {
+	score := math.Log(1+freq/(s.mu*s.p)) + s.cache[norm]
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// MaxScore is the limit of Score as freq and field length grow together
+func (s *lmDirichletScorer) MaxScore() float64 {
+	return math.Max(0, math.Log(maxNormError/s.p))
+}
+
+// DFR is a divergence from randomness similarity using the inverse document
+// frequency basic model, the Laplace after effect and the H2 length
+// normalization, known as I(n)L2. C scales the length normalization and
+// is usually 1
+type DFR struct {
+	C float64
+}
+
+type dfrScorer struct {
+	informativeness float64
+	cache           *[256]float64
+}
+
+func (s DFR) Scorer(stats *TermStats) TermScorer {
+	return &dfrScorer{
+		informativeness: math.Log2((stats.DocCount + 1) / (stats.DocFreq + 0.5)),
+		cache: normCache(func(fieldLen float64) float64 {
+			return math.Log2(1 + s.C*stats.AvgFieldLen/math.Max(fieldLen, 1))
+		}),
+	}
+}
+
+func (s *dfrScorer) Score(freq float64, norm byte) float64 {
+	tfn := freq * s.cache[norm]
+	return s.informativeness * tfn / (tfn + 1)
+}
+
+func (s *dfrScorer) MaxScore() float64 {
+	return s.informativeness
+}
+
+// similarityName identifies a similarity and its parameters, upper bounds of
+// term scores persisted by MarshalIndex are used only with the same similarity
+func similarityName(sim Similarity) string {
+	return fmt.Sprintf("%T%+v", sim, sim)
+}
+
+// SetSimilarity sets the similarity of fields without a Similarity in
+// their FieldOptions, nil restores DefaultSimilarity
+func (idx *InvertedIndex) SetSimilarity(sim Similarity) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.similarity = sim
+}
+
+// Similarity returns the similarity scoring terms of field
+func (idx *InvertedIndex) Similarity(field string) Similarity {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.fieldSimilarity(field)
+}
+
+func (idx *InvertedIndex) fieldSimilarity(field string) Similarity {
+	if sim := idx.schema.Similarity(field); sim != nil {
+		return sim
+	}
+	if idx.similarity != nil {
+		return idx.similarity
+	}
+	return DefaultSimilarity
+}
+
+// termStats returns statistics of a term of field
+func (idx *InvertedIndex) termStats(field string, docFreq int, totalTermFreq float64) *TermStats {
+	return &TermStats{
+		DocCount:      float64(idx.NumDocs),
+		DocFreq:       float64(docFreq),
+		TotalTermFreq: totalTermFreq,
+		AvgFieldLen:   idx.avgFieldLen[field],
+		SumFieldLen:   idx.sumFieldLen[field],
+	}
+}
+
+// postingStats returns statistics of the term of postings
+func (idx *InvertedIndex) postingStats(field string, postings []Posting) *TermStats {
+	var totalTermFreq float64
+	for _, p := range postings {
+		totalTermFreq += float64(p.frequency)
+	}
+	return idx.termStats(field, len(postings), totalTermFreq)
+}
+
+// keyStats returns statistics of the term with dictionary key, they are read
+// from the term dictionary persisted by MarshalIndex while the index is
+// unchanged and computed from postings otherwise
+func (idx *InvertedIndex) keyStats(key string, postings []Posting) *TermStats {
+	field, _ := splitFieldTerm(key)
+
+	if idx.commited {
+		if term, ok := idx.lookupTerm(key); ok {
+			return idx.termStats(field, int(term.DocFreq), float64(term.TotalTermFreq))
+		}
+	}
+
+	return idx.postingStats(field, postings)
+}
+
+// scoreTerm returns scores of documents in postings of the term with
+// dictionary key
+func (idx *InvertedIndex) scoreTerm(key string, postings []Posting) []scoreDoc {
+	field, _ := splitFieldTerm(key)
+	scorer := idx.fieldSimilarity(field).Scorer(idx.keyStats(key, postings))
+	norms := idx.norms[field]
+
+	scores := make([]scoreDoc, len(postings))
+	for i, p := range postings {
+		var norm byte
+		if p.DocId < uint32(len(norms)) {
+			norm = norms[p.DocId]
+		}
+		scores[i] = scoreDoc{p.DocId, float32(scorer.Score(float64(p.frequency), norm))}
+	}
+
+	return scores
+}
+
+// scorePhrase returns scores of phrase matches using their sloppy frequency
+func (idx *InvertedIndex) scorePhrase(field string, postings []Posting, freqs []float64) []scoreDoc {
+	var totalFreq float64
+	for _, freq := range freqs {
+		totalFreq += freq
+	}
+
+	scorer := idx.fieldSimilarity(field).Scorer(idx.termStats(field, len(postings), totalFreq))
+
+	scores := make([]scoreDoc, len(postings))
+	for i, p := range postings {
+		scores[i] = scoreDoc{p.DocId, float32(scorer.Score(freqs[i], idx.getNorm(field, p.DocId)))}
+	}
+
+	return scores
+}
@@ -0,0 +1,130 @@
+package inverted
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimilarityMaxScore(t *testing.T) {
+	similarities := []Similarity{
+		DefaultSimilarity,
+		BM25{K1: 2, B: 0.3},
+		BM25Plus{K1: 1.2, B: 0.75, Delta: 1},
+		TFIDF{},
+		LMDirichlet{Mu: 2000},
+		LMDirichlet{Mu: 10},
+		DFR{C: 1},
+	}
+
+	stats := &TermStats{DocCount: 1000, DocFreq: 20, TotalTermFreq: 60, AvgFieldLen: 12, SumFieldLen: 12000}
+
+	for _, sim := range similarities {
+		scorer := sim.Scorer(stats)
+		bound := scorer.MaxScore()
+		for _, fieldLen := range []uint32{1, 2, 5, 12, 31, 50, 1000, 1151} {
+			for freq := uint32(1); freq <= fieldLen; freq = freq*2 + 1 {
+				score := scorer.Score(float64(freq), encodeNorm(fieldLen))
+				assert.True(t, score >= 0 && score <= bound, "%s freq=%v len=%v score=%v bound=%v", similarityName(sim), freq, fieldLen, score, bound)
+			}
+		}
+
+		// a term in more documents scores lower
+		common := *stats
+		common.DocFreq, common.TotalTermFreq = 500, 1500
+		assert.True(t, scorer.Score(2, encodeNorm(12)) > sim.Scorer(&common).Score(2, encodeNorm(12)), similarityName(sim))
+	}
+}
+
+func TestNorms(t *testing.T) {
+	for length := uint32(0); length < 100000; length++ {
+		norm := encodeNorm(length)
+		decoded := decodeNorm(norm)
+		assert.True(t, decoded <= length && float64(length) <= float64(decoded)*maxNormError, "length %d decoded %d", length, decoded)
+		if length < 24 {
+			assert.Equal(t, length, decoded)
+		}
+		if length > 0 && norm > 0 {
+			assert.True(t, encodeNorm(length-1) <= norm)
+		}
+	}
+	assert.Equal(t, byte(255), encodeNorm(1<<31))
+}
+
+func TestFieldSimilarity(t *testing.T) {
+	schema := NewSchema("body", newTestAnalyzer())
+	assert.NoError(t, schema.AddField("title", FieldOptions{Analyzer: newTestAnalyzer(), Similarity: TFIDF{}}))
+
+	dir := t.TempDir()
+	opts := Options{Schema: schema, Similarity: BM25{K1: 1.2, B: 0}}
+	idx, err := Create(dir, opts)
+	assert.NoError(t, err)
+
+	for _, doc := range [][2]string{{"red shoes", "red"}, {"red", "red shoes for running in the rain"}, {"blue", "shoes"}} {
+		_, err = idx.AddDocument(NewDocument().AddField("title", doc[0]).AddField("body", doc[1]), nil)
+		assert.NoError(t, err)
+	}
+	idx.UpdateAvgFieldLen()
+
+	assert.Equal(t, TFIDF{}, idx.Similarity("title"))
+	assert.Equal(t, BM25{K1: 1.2, B: 0}, idx.Similarity("body"))
+
+	// without length normalization both body matches score the same
+	result, err := idx.Execute(&TermQuery{Field: "body", Term: "red"}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.Equal(t, result[0].Boost, result[1].Boost)
+
+	// TF-IDF prefers the shorter title
+	result, err = idx.Execute(&TermQuery{Field: "title", Term: "red"}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), result[0].DocId)
+
+	assert.NoError(t, idx.MarshalIndex())
+
+	// bounds persisted for another similarity are not used for pruning
+	opts.Similarity = LMDirichlet{Mu: 100}
+	loaded, err := Open(dir, opts)
+	assert.NoError(t, err)
+
+	query := &BooleanQuery{Should: []Query{&TermQuery{Field: "body", Term: "red"}, &TermQuery{Field: "body", Term: "shoes"}}}
+	all, err := loaded.match(query, SearchOptions{})
+	assert.NoError(t, err)
+	top, err := loaded.ExecuteTop(query, SearchOptions{Size: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, postingIds(scorePostings(topK(all, 1))), postingIds(top.Hits))
+	assert.NotEqual(t, loaded.boundSimilarity["body"], similarityName(loaded.Similarity("body")))
+}
+
+func TestPersistedScoringStats(t *testing.T) {
+	dir := t.TempDir()
+	idx, err := Create(dir, Options{Schema: newTestSchema()})
+	assert.NoError(t, err)
+
+	for _, body := range []string{"red red apple", "red car with a very long description of the car", "green apple", "red"} {
+		_, err = idx.AddDocument(NewDocument().AddField("body", body), nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, idx.Delete(3))
+	assert.NoError(t, idx.MarshalIndex())
+
+	term, ok := idx.lookupTerm("body:red")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), term.DocFreq)
+	assert.Equal(t, uint64(3), term.TotalTermFreq)
+
+	want, err := idx.Execute(&TermQuery{Field: "body", Term: "red"}, SearchOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{0, 1}, postingIds(want))
+
+	for _, loadIntoMemory := range []bool{false, true} {
+		loaded, err := Open(dir, Options{Schema: newTestSchema(), LoadIntoMemory: loadIntoMemory})
+		assert.NoError(t, err)
+		assert.Equal(t, idx.norms, loaded.norms)
+		assert.Equal(t, idx.sumFieldLen, loaded.sumFieldLen)
+
+		got, err := loaded.Execute(&TermQuery{Field: "body", Term: "red"}, SearchOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+}
@@ -0,0 +1,113 @@
+package inverted
+
+import (
+	"sort"
+	"strings"
+)
+
+// spellCheckCandidates is the number of candidates returned for each token
+const spellCheckCandidates = 5
+
+// TokenSuggestion holds spelling candidates of a single analyzed query token
+type TokenSuggestion struct {
+	Field string
+	Token string
+
+	// DocFreq is the number of documents containing the token
+	DocFreq int
+
+	// Candidates are indexed terms within a few edits of the token that are
+	// more frequent than the token, the closest and most frequent first.
+	// Count of each candidate is the number of documents containing it
+	Candidates []FacetCount
+}
+
+// SpellCheckResult holds spelling corrections of a query
+type SpellCheckResult struct {
+	Tokens []TokenSuggestion
+
+	// Suggestion is the query with every token missing from the index replaced
+	// by its best candidate, it is empty if no token could be corrected
+	Suggestion string
+}
+
+/*
+SpellCheck proposes corrections of q drawn from the term dictionary. Words of
+q are analyzed like in Search so candidates are indexed forms of terms,
+words can be prefixed with a field name and a colon like "title:foo".
+
+Candidates of a token are terms of its field within AutoFuzziness edits, at
+least one, that occur in more documents than the token itself.
+*/
+func (idx *InvertedIndex) SpellCheck(q string) SpellCheckResult {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	result := SpellCheckResult{Tokens: make([]TokenSuggestion, 0)}
+
+	words := make([]string, 0)
+	corrected := false
+
+	for _, term := range idx.analyzeQuery(q) {
+		ts := TokenSuggestion{
+			Field:      term.field,
+			Token:      term.value,
+			DocFreq:    idx.docFreq(term.key()),
+			Candidates: idx.spellCandidates(term),
+		}
+		result.Tokens = append(result.Tokens, ts)
+
+		word := term.value
+		if ts.DocFreq == 0 && len(ts.Candidates) > 0 {
+			word = ts.Candidates[0].Name
+			corrected = true
+		}
+
+		if term.field != idx.schema.DefaultField() {
+			word = term.field + ":" + word
+		}
+		words = append(words, word)
+	}
+
+	if corrected {
+		result.Suggestion = strings.Join(words, " ")
+	}
+
+	return result
+}
+
+// spellCandidates returns terms similar to term that are more frequent
+func (idx *InvertedIndex) spellCandidates(term queryTerm) []FacetCount {
+	maxEdits := AutoFuzziness(term.value)
+	if maxEdits == 0 {
+		maxEdits = 1
+	}
+
+	docFreq := uint32(idx.docFreq(term.key()))
+
+	matches := make([]fuzzyTerm, 0)
+	for _, match := range idx.expandFuzzy(term.field, term.value, maxEdits, 0) {
+		if match.distance > 0 && match.term.DocFreq > docFreq {
+			matches = append(matches, match)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].term.DocFreq > matches[j].term.DocFreq
+	})
+
+	if len(matches) > spellCheckCandidates {
+		matches = matches[:spellCheckCandidates]
+	}
+
+	candidates := make([]FacetCount, 0, len(matches))
+	for _, match := range matches {
+		_, value := splitFieldTerm(match.term.Value)
+		candidates = append(candidates, FacetCount{value, int(match.term.DocFreq)})
+	}
+
+	return candidates
+}
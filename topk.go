@@ -0,0 +1,131 @@
+package inverted
+
+import "container/heap"
+
+// DefaultPageSize is the number of hits returned by ExecuteTop when
+// SearchOptions.Size is not set
+const DefaultPageSize = 10
+
+// TopDocs is a page of the best scoring documents of a query
+type TopDocs struct {
+	// TotalHits is the number of documents matching the query, a lower
+	// bound if TotalHitsLowerBound is set
+	TotalHits int
+
+	// TotalHitsLowerBound is set if documents that could not enter the
+	// page were skipped without being counted, see ExecuteTop
+	TotalHitsLowerBound bool
+
+	// Hits are the documents of the page sorted by score
+	Hits []Posting
+}
+
+// scoreHeap is a min-heap keeping the worst of the best documents on top
+type scoreHeap []scoreDoc
+
+func (h scoreHeap) Len() int            { return len(h) }
+func (h scoreHeap) Less(i, j int) bool  { return worse(h[i], h[j]) }
+func (h scoreHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scoreHeap) Push(x interface{}) { *h = append(*h, x.(scoreDoc)) }
+
+func (h *scoreHeap) Pop() interface{} {
+	old := *h
+	doc := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return doc
+}
+
+// offer adds a document to a heap holding at most k best documents
+func (h *scoreHeap) offer(doc scoreDoc, k int) {
+	if len(*h) < k {
+		heap.Push(h, doc)
+	} else if worse((*h)[0], doc) {
+		(*h)[0] = doc
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted empties the heap and returns its documents from the best score
+func (h *scoreHeap) sorted() []scoreDoc {
+	result := make([]scoreDoc, len(*h))
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(h).(scoreDoc)
+	}
+	return result
+}
+
+// topK returns the k best scoring documents sorted by score, it keeps a
+// bounded heap instead of sorting all documents
+func topK(scores []scoreDoc, k int) []scoreDoc {
+	if k > len(scores) {
+		k = len(scores)
+	}
+	if k <= 0 {
+		return []scoreDoc{}
+	}
+
+	h := make(scoreHeap, 0, k)
+	for _, doc := range scores {
+		h.offer(doc, k)
+	}
+
+	return h.sorted()
+}
+
+// ExecuteTop runs a query and returns the page of opts.Size best scoring
+// documents starting at opts.From, only From+Size documents are ranked.
+// Disjunctions of terms are evaluated with WAND, see executeWand, documents
+// it skips are not counted in TotalHits
+func (idx *InvertedIndex) ExecuteTop(query Query, opts SearchOptions) (*TopDocs, error) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return idx.executeTop(query, opts)
+}
+
+func (idx *InvertedIndex) executeTop(query Query, opts SearchOptions) (*TopDocs, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+
+	from := opts.From
+	if from < 0 {
+		from = 0
+	}
+
+	var hits []scoreDoc
+	var total int
+	var lowerBound bool
+
+	if terms, boost, ok := disjunctionTerms(query); ok && opts.Fuzziness == 0 {
+		var err error
+		hits, total, lowerBound, err = idx.executeWand(terms, boost, from+size, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		result, err := idx.match(query, opts)
+		if err != nil {
+			return nil, err
+		}
+		hits, total = topK(result, from+size), len(result)
+	}
+
+	if from > len(hits) {
+		from = len(hits)
+	}
+
+	return &TopDocs{TotalHits: total, TotalHitsLowerBound: lowerBound, Hits: scorePostings(hits[from:])}, nil
+}
+
+// SearchPage parses q with the query language of QueryParser and returns
+// size best scoring documents starting at from
+func (idx *InvertedIndex) SearchPage(q string, from, size int) (*TopDocs, error) {
+	query, err := NewQueryParser(idx.schema).Parse(q)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.ExecuteTop(query, SearchOptions{From: from, Size: size})
+}
@@ -216,8 +216,9 @@ func Intersection(arr1, arr2 []Posting) []Posting {
 		} else if arr2[j].DocId < arr1[i].DocId {
 			j++
 		} else {
-			arr2[j].Boost += arr1[i].Boost
+			// sum scores in the result, input postings are not modified
 			p = append(p, arr2[j])
+			p[len(p)-1].Boost += arr1[i].Boost
 			j++
 			i++
 		}
@@ -242,8 +243,8 @@ func Union(arr1 []Posting, arr2 []Posting) []Posting {
 			p = append(p, arr2[j])
 			j++
 		} else {
-			arr2[j].Boost += arr1[i].Boost
 			p = append(p, arr2[j])
+			p[len(p)-1].Boost += arr1[i].Boost
 			j++
 			i++
 		}
@@ -0,0 +1,320 @@
+package inverted
+
+import "sort"
+
+// wandPostings iterates postings of a wand clause, postingIterator reads
+// them from disk and slicePostings from memory
+type wandPostings interface {
+	Next() bool
+	Advance(target uint32) bool
+	DocId() uint32
+	Freq() uint32
+	Err() error
+}
+
+// slicePostings iterates postings of an in memory index
+type slicePostings struct {
+	postings []Posting
+	i        int
+}
+
+func newSlicePostings(postings []Posting) *slicePostings {
+	return &slicePostings{postings: postings, i: -1}
+}
+
+func (it *slicePostings) Next() bool {
+	it.i++
+	return it.i < len(it.postings)
+}
+
+// Advance moves to the first posting with a DocId not less than target
+// starting from the current posting
+func (it *slicePostings) Advance(target uint32) bool {
+	if it.i < 0 {
+		it.i = 0
+	}
+	rest := it.postings[it.i:]
+	it.i += sort.Search(len(rest), func(i int) bool { return rest[i].DocId >= target })
+	return it.i < len(it.postings)
+}
+
+func (it *slicePostings) DocId() uint32 { return it.postings[it.i].DocId }
+func (it *slicePostings) Freq() uint32  { return it.postings[it.i].frequency }
+func (it *slicePostings) Err() error    { return nil }
+
+// Positions returns positions of the current posting
+func (it *slicePostings) Positions() []uint32 {
+	return it.postings[it.i].positions
+}
+
+// wandClause is a term of a disjunction evaluated document at a time
+type wandClause struct {
+	it     wandPostings
+	more   bool
+	scorer TermScorer
+	norms  []byte
+	boost  float32
+
+	// maxScore is the upper bound of the score the clause adds to a document
+	maxScore float64
+}
+
+func (c *wandClause) exhausted() bool {
+	return !c.more
+}
+
+func (c *wandClause) doc() uint32 {
+	return c.it.DocId()
+}
+
+func (c *wandClause) next() {
+	c.more = c.it.Next()
+}
+
+// advance moves to the first posting with a DocId not less than target
+func (c *wandClause) advance(target uint32) {
+	c.more = c.it.Advance(target)
+}
+
+// score returns the score of the current posting like TermQuery does
+func (c *wandClause) score() float32 {
+	docId := c.it.DocId()
+
+	var norm byte
+	if docId < uint32(len(c.norms)) {
+		norm = c.norms[docId]
+	}
+
+	score := float32(c.scorer.Score(float64(c.it.Freq()), norm))
+	if c.boost != 0 && c.boost != 1 {
+		score *= c.boost
+	}
+	return score
+}
+
+// disjunctionTerms returns the clauses and boost of a boolean query made of
+// optional term clauses only, the queries that executeWand can evaluate
+func disjunctionTerms(query Query) ([]*TermQuery, float32, bool) {
+	q, ok := query.(*BooleanQuery)
+	if !ok || len(q.Must) > 0 || len(q.MustNot) > 0 || len(q.Filter) > 0 || len(q.Should) < 2 {
+		return nil, 0, false
+	}
+
+	terms := make([]*TermQuery, 0, len(q.Should))
+	for _, clause := range q.Should {
+		term, ok := clause.(*TermQuery)
+		if !ok {
+			return nil, 0, false
+		}
+		terms = append(terms, term)
+	}
+
+	return terms, q.Boost, true
+}
+
+// termMaxScore returns an upper bound of the score of a term in any document,
+// the bound computed by MarshalIndex is used while the index and similarity
+// of the field are unchanged
+func (idx *InvertedIndex) termMaxScore(key, field string, sim Similarity, scorer TermScorer) float64 {
+	if idx.commited && idx.boundSimilarity[field] == similarityName(sim) {
+		if term, ok := idx.lookupTerm(key); ok && term.MaxScore > 0 {
+			return float64(term.MaxScore)
+		}
+	}
+
+	return scorer.MaxScore()
+}
+
+// computeTermStats sets the total frequency and the upper bound of the
+// score of every term of the dictionary, it is called by MarshalIndex
+// after statistics are updated
+func (idx *InvertedIndex) computeTermStats() {
+	terms := idx.termDictionary()
+
+	idx.boundSimilarity = make(map[string]string)
+
+	for i := range terms {
+		field, _ := splitFieldTerm(terms[i].Value)
+		postings := idx.index[terms[i].Value]
+
+		sim := idx.fieldSimilarity(field)
+		stats := idx.postingStats(field, postings)
+		scorer := sim.Scorer(stats)
+		idx.boundSimilarity[field] = similarityName(sim)
+
+		var maxScore float32
+		for _, p := range postings {
+			score := float32(scorer.Score(float64(p.frequency), idx.getNorm(field, p.DocId)))
+			if score > maxScore {
+				maxScore = score
+			}
+		}
+
+		terms[i].TotalTermFreq = uint64(stats.TotalTermFreq)
+		terms[i].MaxScore = maxScore
+	}
+}
+
+// wandSlack inflates upper bounds so float32 rounding of scores summed in a
+// different order never prunes a document that belongs to the top k
+const wandSlack = 1.0001
+
+/*
+executeWand returns the top k documents of a disjunction of terms using the
+WAND algorithm. Clauses are kept sorted by their current document, the
+pivot is the first clause where the sum of upper bounds of the clauses
+before it can beat the lowest score of the top k. Documents before the
+pivot cannot enter the top k and are skipped without being scored.
+
+Posting lists of a read only index are iterated on disk a segment at a
+time, skipping blocks of the skipped documents. Only documents that are
+scored are counted, total is a lower bound if documents were skipped.
+*/
+func (idx *InvertedIndex) executeWand(terms []*TermQuery, boost float32, k int, opts SearchOptions) (hits []scoreDoc, total int, lowerBound bool, err error) {
+	segments, onDisk, err := idx.iterableSegments()
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	// clauses in query order, scores are summed in this order like Union does
+	clauses := make([]*wandClause, len(terms))
+	memory := make([][]Posting, len(terms))
+
+	for i, term := range terms {
+		key := fieldTerm(term.Field, term.Term)
+
+		if !onDisk {
+			memory[i], err = idx.termPostings(key, false)
+			if err != nil {
+				return nil, 0, false, err
+			}
+		}
+
+		sim := idx.fieldSimilarity(term.Field)
+		c := &wandClause{
+			scorer: sim.Scorer(idx.keyStats(key, memory[i])),
+			norms:  idx.norms[term.Field],
+			boost:  term.Boost,
+		}
+		c.maxScore = idx.termMaxScore(key, term.Field, sim, c.scorer) * float64(boostOrOne(term.Boost)) * float64(boostOrOne(boost)) * wandSlack
+		clauses[i] = c
+	}
+
+	h := make(scoreHeap, 0, k)
+
+	if !onDisk {
+		for i, c := range clauses {
+			c.it = newSlicePostings(memory[i])
+		}
+
+		total, lowerBound, err = idx.wand(clauses, boost, k, opts, &h)
+		return h.sorted(), total, lowerBound, err
+	}
+
+	// segments hold distinct documents and share the top k
+	for _, s := range segments {
+		for i, term := range terms {
+			buf, err := s.postingList(fieldTerm(term.Field, term.Term))
+			if err != nil {
+				return nil, 0, false, err
+			}
+
+			// a missing term is an empty list
+			clauses[i].it = newSlicePostings(nil)
+			if buf != nil {
+				clauses[i].it, err = newPostingIterator(buf, s.format)
+				if err != nil {
+					return nil, 0, false, err
+				}
+			}
+		}
+
+		n, skipped, err := idx.wand(clauses, boost, k, opts, &h)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		total += n
+		lowerBound = lowerBound || skipped
+	}
+
+	return h.sorted(), total, lowerBound, nil
+}
+
+// wand offers documents of clauses that can enter the top k to h, it
+// returns the number of documents scored and whether documents were skipped
+func (idx *InvertedIndex) wand(ordered []*wandClause, boost float32, k int, opts SearchOptions, h *scoreHeap) (int, bool, error) {
+	clauses := make([]*wandClause, 0, len(ordered))
+	for _, c := range ordered {
+		c.next()
+		clauses = append(clauses, c)
+	}
+
+	scored, skipped := 0, false
+
+	for k > 0 {
+		sort.SliceStable(clauses, func(i, j int) bool {
+			if clauses[i].exhausted() || clauses[j].exhausted() {
+				return !clauses[i].exhausted() && clauses[j].exhausted()
+			}
+			return clauses[i].doc() < clauses[j].doc()
+		})
+
+		// find the pivot clause
+		pivot := -1
+		var bound float64
+		for i, c := range clauses {
+			if c.exhausted() {
+				break
+			}
+			bound += c.maxScore
+			if len(*h) < k || bound > float64((*h)[0].Score) {
+				pivot = i
+				break
+			}
+		}
+		if pivot < 0 {
+			skipped = skipped || !clauses[0].exhausted()
+			break
+		}
+
+		pivotDoc := clauses[pivot].doc()
+
+		if clauses[0].doc() != pivotDoc {
+			// documents before the pivot document cannot enter the top k
+			for _, c := range clauses[:pivot] {
+				c.advance(pivotDoc)
+			}
+			skipped = true
+			continue
+		}
+
+		if !idx.deleted.Contains(pivotDoc) && (opts.Filter == nil || opts.Filter.Contains(pivotDoc)) {
+			var score float32
+			for _, c := range ordered {
+				if !c.exhausted() && c.doc() == pivotDoc {
+					score += c.score()
+				}
+			}
+			if boost != 0 && boost != 1 {
+				score *= boost
+			}
+
+			h.offer(scoreDoc{pivotDoc, score}, k)
+			scored++
+		}
+
+		for _, c := range clauses {
+			if !c.exhausted() && c.doc() == pivotDoc {
+				c.next()
+			}
+		}
+	}
+
+	for _, c := range ordered {
+		if err := c.it.Err(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	return scored, skipped, nil
+}
@@ -0,0 +1,181 @@
+package inverted
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultMaxExpansions is the number of terms a WildcardQuery or RegexpQuery
+// may expand to when MaxExpansions is not set
+const DefaultMaxExpansions = 1024
+
+// WildcardQuery matches documents containing any term of a field matching
+// Pattern, where "*" matches any sequence of characters and "?" matches a
+// single character. A backslash escapes the next character
+type WildcardQuery struct {
+	Field   string
+	Pattern string
+
+	// MaxExpansions limits the number of matching terms, ErrTooManyTerms is
+	// returned if more terms match. Zero means DefaultMaxExpansions
+	MaxExpansions int
+
+	// ConstantScore gives every matching document a score of Boost instead
+	// of scoring matching terms like a TermQuery
+	ConstantScore bool
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+// RegexpQuery matches documents containing any term of a field entirely
+// matching the regular expression Pattern, see regexp/syntax for the syntax
+type RegexpQuery struct {
+	Field   string
+	Pattern string
+
+	// MaxExpansions limits the number of matching terms, ErrTooManyTerms is
+	// returned if more terms match. Zero means DefaultMaxExpansions
+	MaxExpansions int
+
+	// ConstantScore gives every matching document a score of Boost instead
+	// of scoring matching terms like a TermQuery
+	ConstantScore bool
+
+	// Boost multiplies the score of matching documents, zero means 1
+	Boost float32
+}
+
+func (q *WildcardQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	re, err := compileWildcard(q.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.executePattern(q.Field, q.Pattern, re, q.MaxExpansions, q.ConstantScore, q.Boost)
+}
+
+func (q *RegexpQuery) execute(idx *InvertedIndex) ([]scoreDoc, error) {
+	re, err := regexp.Compile("^(?:" + q.Pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	return idx.executePattern(q.Field, q.Pattern, re, q.MaxExpansions, q.ConstantScore, q.Boost)
+}
+
+func (idx *InvertedIndex) executePattern(field, pattern string, re *regexp.Regexp, maxExpansions int, constantScore bool, boost float32) ([]scoreDoc, error) {
+	terms, err := idx.expandPattern(field, re, maxExpansions)
+	if err != nil {
+		return nil, fmt.Errorf("%w: pattern %q", err, pattern)
+	}
+
+	if !constantScore {
+		return idx.executeTerms(field, terms, boost)
+	}
+
+	var result []scoreDoc
+
+	for _, term := range terms {
+		postings, err := idx.termPostings(term.Value, false)
+		if err != nil {
+			return nil, err
+		}
+		result = unionScores(result, newScores(postings, 0))
+	}
+
+	return setScores(result, boostOrOne(boost)), nil
+}
+
+// expandPattern returns terms of field entirely matching re, only terms
+// starting with the literal prefix of re are tested
+func (idx *InvertedIndex) expandPattern(field string, re *regexp.Regexp, maxExpansions int) ([]Term, error) {
+	if maxExpansions <= 0 {
+		maxExpansions = DefaultMaxExpansions
+	}
+
+	prefix, _ := re.LiteralPrefix()
+	key := fieldTerm(field, prefix)
+
+	terms := make([]Term, 0)
+	for _, term := range idx.expandPrefix(key) {
+		if !re.MatchString(term.Value[len(key)-len(prefix):]) {
+			continue
+		}
+
+		if len(terms) == maxExpansions {
+			return nil, fmt.Errorf("%w: more than %d terms", ErrTooManyTerms, maxExpansions)
+		}
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+// compileWildcard converts a wildcard pattern to an anchored regular expression
+func compileWildcard(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^(?s)")
+
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i == len(pattern) {
+				return nil, fmt.Errorf("escape character at end of wildcard pattern %q", pattern)
+			}
+			r, size = utf8.DecodeRuneInString(pattern[i:])
+			i += size
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	sb.WriteString("$")
+
+	return regexp.Compile(sb.String())
+}
+
+// normalizeWildcard analyzes the literal parts of a wildcard pattern with
+// analyzer like prefixes, wildcards and escaped characters are kept as is
+func normalizeWildcard(analyzer Analyzer, pattern string) string {
+	var sb, literal strings.Builder
+
+	flush := func() {
+		if literal.Len() > 0 {
+			sb.WriteString(normalizeTerm(analyzer, literal.String()))
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(pattern); {
+		r, size := utf8.DecodeRuneInString(pattern[i:])
+
+		switch {
+		case r == '*' || r == '?':
+			flush()
+			sb.WriteRune(r)
+		case r == '\\' && i+size < len(pattern):
+			flush()
+			_, next := utf8.DecodeRuneInString(pattern[i+size:])
+			sb.WriteString(pattern[i : i+size+next])
+			size += next
+		default:
+			literal.WriteRune(r)
+		}
+
+		i += size
+	}
+	flush()
+
+	return sb.String()
+}